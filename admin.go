@@ -0,0 +1,468 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// maxRecentErrors is how many errors each SMCache keeps for RecentErrors.
+	maxRecentErrors = 50
+
+	// defaultAdminMaxKeys is used when AdminOptions.MaxKeys is not set.
+	defaultAdminMaxKeys = 100
+
+	// adminConcurrency is how many keys AdminHandler inspects at once.
+	adminConcurrency = 8
+)
+
+// AdminOptions configures AdminHandler.
+type AdminOptions struct {
+	// Authorize is called for every request, which is rejected with 403
+	// Forbidden if it returns an error. Use it to check a token, a client
+	// certificate or the identity set by an authenticating proxy.
+	// Optional, defaults to only allowing requests from loopback addresses.
+	Authorize func(r *http.Request) error
+
+	// MaxKeys is how many keys are inspected per request. Each key costs a
+	// SecretVersion read and, for certificates, an access of its data.
+	// Optional, defaults to 100.
+	MaxKeys int
+}
+
+// AdminReport is what AdminHandler shows. Payload data is never included.
+type AdminReport struct {
+	Time   time.Time    `json:"time"`
+	Shards []AdminShard `json:"shards"`
+}
+
+// AdminShard describes one SMCache in an AdminReport.
+type AdminShard struct {
+	// Config is the cache's Config, formatted for display. Hooks and
+	// Backend are only described, and DebugLogging is left out.
+	Config map[string]string `json:"config"`
+
+	// Stats is the cache's in-memory state.
+	Stats Stats `json:"stats"`
+
+	// Keys are the keys stored under SecretPrefix, up to AdminOptions.MaxKeys.
+	// KeysTruncated is set if there were more, and KeysError if they could
+	// not be listed.
+	Keys          []AdminKey `json:"keys"`
+	KeysTruncated bool       `json:"keysTruncated,omitempty"`
+	KeysError     string     `json:"keysError,omitempty"`
+
+	// Errors are the most recent errors, newest first. See RecentErrors.
+	Errors []ErrorRecord `json:"errors"`
+}
+
+// AdminKey describes one stored key in an AdminReport.
+type AdminKey struct {
+	// Key, SecretName, CreateTime and ExpireTime are as in Entry.
+	Key        string    `json:"key"`
+	SecretName string    `json:"secretName"`
+	CreateTime time.Time `json:"createTime"`
+	ExpireTime time.Time `json:"expireTime"`
+
+	// LatestVersion is the resource name of the secret's latest SecretVersion,
+	// or empty if it has none.
+	LatestVersion     string    `json:"latestVersion,omitempty"`
+	VersionState      string    `json:"versionState,omitempty"`
+	VersionCreateTime time.Time `json:"versionCreateTime"`
+
+	// CertNotAfter is when the certificate in the latest version expires. It's
+	// zero for keys that aren't certificates, and for versions that aren't enabled.
+	CertNotAfter time.Time `json:"certNotAfter"`
+
+	// Error is set if the key could not be inspected.
+	Error string `json:"error,omitempty"`
+}
+
+// ErrorRecord is an error returned by Get, Put or Delete, or hit by the
+// WriteBehind worker or a background refresh of a stale value.
+type ErrorRecord struct {
+	Time  time.Time `json:"time"`
+	Op    Op        `json:"op"`
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+}
+
+// RecentErrors returns the most recent errors, newest first. Cache misses
+// are not errors.
+func (smc *SMCache) RecentErrors() []ErrorRecord {
+	return smc.errs.recent()
+}
+
+// errorLog keeps the last maxRecentErrors errors. The zero value is ready to use.
+type errorLog struct {
+	mu      sync.Mutex
+	records []ErrorRecord
+	next    int // where the next record goes, once records is full
+}
+
+func (l *errorLog) add(op Op, key string, err error) {
+	if err == nil || errors.Is(err, autocert.ErrCacheMiss) {
+		return
+	}
+
+	r := ErrorRecord{Time: time.Now(), Op: op, Key: key, Error: err.Error()}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.records) < maxRecentErrors {
+		l.records = append(l.records, r)
+		return
+	}
+
+	l.records[l.next] = r
+	l.next = (l.next + 1) % maxRecentErrors
+}
+
+func (l *errorLog) recent() []ErrorRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := make([]ErrorRecord, 0, len(l.records))
+	for i := len(l.records) - 1; i >= 0; i-- {
+		recent = append(recent, l.records[(l.next+i)%len(l.records)])
+	}
+
+	return recent
+}
+
+// AdminHandler returns an http.Handler that shows the cache's Config, stored
+// keys with their latest version and certificate expiry, in-memory state and
+// recent errors. It serves HTML, or JSON (an AdminReport) if the request has
+// "format=json" in its query or accepts application/json. Payload data is
+// never shown.
+//
+// Listing keys needs the same permissions as Keys, plus
+// secretmanager.versions.get and secretmanager.versions.access.
+func (smc *SMCache) AdminHandler(opts *AdminOptions) http.Handler {
+	return newAdminHandler(opts, []*SMCache{smc})
+}
+
+// AdminHandler returns an http.Handler that shows every shard. See SMCache.AdminHandler.
+func (r *Router) AdminHandler(opts *AdminOptions) http.Handler {
+	return newAdminHandler(opts, r.shards)
+}
+
+type adminHandler struct {
+	opts   AdminOptions
+	caches []*SMCache
+}
+
+func newAdminHandler(opts *AdminOptions, caches []*SMCache) *adminHandler {
+	h := &adminHandler{caches: caches}
+	if opts != nil {
+		h.opts = *opts
+	}
+
+	if h.opts.Authorize == nil {
+		h.opts.Authorize = loopbackOnly
+	}
+
+	if h.opts.MaxKeys <= 0 {
+		h.opts.MaxKeys = defaultAdminMaxKeys
+	}
+
+	return h
+}
+
+// loopbackOnly is the default AdminOptions.Authorize.
+func loopbackOnly(r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("[%v] is not a loopback address", r.RemoteAddr)
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.opts.Authorize(r); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	report := AdminReport{Time: time.Now()}
+	for _, smc := range h.caches {
+		report.Shards = append(report.Shards, smc.adminShard(r.Context(), h.opts.MaxKeys))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := adminTemplate.Execute(w, report); err != nil {
+		h.caches[0].logf("problem writing admin page. %v", err)
+	}
+}
+
+// adminShard builds the AdminShard of the cache.
+func (smc *SMCache) adminShard(ctx context.Context, maxKeys int) AdminShard {
+	s := AdminShard{
+		Config: smc.adminConfig(),
+		Stats:  smc.Stats(),
+		Errors: smc.RecentErrors(),
+	}
+
+	keys, truncated, err := smc.adminKeys(ctx, maxKeys)
+	s.Keys = keys
+	s.KeysTruncated = truncated
+
+	if err != nil {
+		s.KeysError = err.Error()
+	}
+
+	return s
+}
+
+// adminConfig formats the Config for display.
+func (smc *SMCache) adminConfig() map[string]string {
+	c := smc.Config
+	m := map[string]string{
+		"ProjectID":            smc.projectID(),
+		"Location":             c.Location,
+		"SecretPrefix":         c.SecretPrefix,
+		"KeepOldCertificates":  fmt.Sprint(c.KeepOldCertificates),
+		"KMSKeyName":           c.KMSKeyName,
+		"HTTPTokenTTL":         smc.httpTokenTTL().String(),
+		"HTTPTokenMemoryCache": fmt.Sprint(c.HTTPTokenMemoryCache),
+		"MissCacheTTL":         c.MissCacheTTL.String(),
+		"MaxStaleness":         c.MaxStaleness.String(),
+		"WriteBehind":          fmt.Sprint(c.WriteBehind),
+		"JournalDir":           c.JournalDir,
+		"Compress":             fmt.Sprint(c.Compress),
+		"Envelope":             fmt.Sprint(c.Envelope),
+		"Labels":               fmt.Sprint(c.Labels),
+		"Topics":               strings.Join(c.Topics, ", "),
+		"DeleteMode":           string(c.DeleteMode),
+		"ReadLimit":            fmt.Sprintf("%+v", c.ReadLimit),
+		"WriteLimit":           fmt.Sprintf("%+v", c.WriteLimit),
+		"Backend":              "Secret Manager",
+		"Hooks":                fmt.Sprintf("Before: %v, After: %v", c.Hooks.Before != nil, c.Hooks.After != nil),
+		"WatchInterval":        c.WatchInterval.String(),
+		"Timeout":              c.Timeout.String(),
+	}
+
+	if c.Backend != nil {
+		m["Backend"] = fmt.Sprintf("%T", c.Backend)
+	}
+
+	if ak := c.AccountKey; ak != nil {
+		m["AccountKey"] = fmt.Sprintf("%+v", *ak)
+	}
+
+	return m
+}
+
+// adminKeys inspects up to maxKeys of the stored keys. It reports whether
+// there were more.
+func (smc *SMCache) adminKeys(ctx context.Context, maxKeys int) ([]AdminKey, bool, error) {
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	it := smc.Entries(ctx, nil)
+	defer it.Stop()
+
+	var entries []Entry
+
+	truncated := false
+
+	for {
+		e, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(entries) == maxKeys {
+			truncated = true
+			break
+		}
+
+		entries = append(entries, e)
+	}
+
+	conn, err := smc.backend().Open(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer conn.Close()
+
+	keys := make([]AdminKey, len(entries))
+
+	var g errgroup.Group
+	g.SetLimit(adminConcurrency)
+
+	for i, e := range entries {
+		i, e := i, e
+
+		g.Go(func() error {
+			keys[i] = adminKey(conn, e)
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+
+	return keys, truncated, nil
+}
+
+// adminKey inspects the latest version of the entry's secret.
+func adminKey(conn BackendConn, e Entry) AdminKey {
+	k := AdminKey{
+		Key:        e.Key,
+		SecretName: e.SecretName,
+		CreateTime: e.CreateTime,
+		ExpireTime: e.ExpireTime,
+	}
+
+	v, err := conn.LatestVersion(e.SecretName)
+	if errors.Is(err, ErrNotFound) {
+		return k
+	}
+
+	if err != nil {
+		k.Error = err.Error()
+		return k
+	}
+
+	k.LatestVersion = v.Name
+	k.VersionState = v.State.String()
+	k.VersionCreateTime = v.CreateTime
+
+	if v.State != VersionEnabled || !e.Exact || prewarmHello(e.Key) == nil {
+		return k
+	}
+
+	stored, _, err := conn.AccessLatest(e.SecretName)
+	if err != nil {
+		k.Error = err.Error()
+		return k
+	}
+
+	data, err := decodePayload(stored)
+	if err == nil {
+		k.CertNotAfter, err = certNotAfter(data)
+	}
+
+	if err != nil {
+		k.Error = fmt.Sprintf("problem reading certificate. %v", err)
+	}
+
+	return k
+}
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>smcache</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>smcache</h1>
+<p>As of {{time .Time}}. <a href="?format=json">JSON</a></p>
+{{range $i, $s := .Shards}}
+<h2>Shard {{$i}}: {{index $s.Config "SecretPrefix"}} in {{index $s.Config "ProjectID"}}</h2>
+
+<h3>Config</h3>
+<table>
+{{range $k, $v := $s.Config}}<tr><th>{{$k}}</th><td>{{$v}}</td></tr>
+{{end}}</table>
+
+<h3>In-memory state</h3>
+<table>
+<tr><th>Stale entries</th><td>{{$s.Stats.StaleEntries}}</td></tr>
+<tr><th>Staleness</th><td>{{$s.Stats.Staleness}}</td></tr>
+<tr><th>Stale values served</th><td>{{$s.Stats.StaleServed}}</td></tr>
+<tr><th>Refreshes (errors)</th><td>{{$s.Stats.Refreshes}} ({{$s.Stats.RefreshErrors}})</td></tr>
+<tr><th>http-01 tokens in memory</th><td>{{$s.Stats.TokenEntries}}</td></tr>
+<tr><th>Remembered misses</th><td>{{$s.Stats.MissEntries}}</td></tr>
+<tr><th>Pending writes</th><td>{{$s.Stats.PendingWrites}}</td></tr>
+</table>
+
+<h3>Keys</h3>
+{{if $s.KeysError}}<p class="error">{{$s.KeysError}}</p>{{end}}
+<table>
+<tr><th>Key</th><th>Secret created</th><th>Secret expires</th><th>Latest version</th><th>State</th><th>Version created</th><th>Certificate expires</th><th>Error</th></tr>
+{{range $s.Keys}}<tr><td>{{.Key}}</td><td>{{time .CreateTime}}</td><td>{{time .ExpireTime}}</td><td>{{.LatestVersion}}</td><td>{{.VersionState}}</td><td>{{time .VersionCreateTime}}</td><td>{{time .CertNotAfter}}</td><td class="error">{{.Error}}</td></tr>
+{{end}}</table>
+{{if $s.KeysTruncated}}<p>More keys are not shown.</p>{{end}}
+
+<h3>Recent errors</h3>
+<table>
+<tr><th>Time</th><th>Op</th><th>Key</th><th>Error</th></tr>
+{{range $s.Errors}}<tr><td>{{time .Time}}</td><td>{{.Op}}</td><td>{{.Key}}</td><td class="error">{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
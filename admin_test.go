@@ -0,0 +1,204 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newAdminCache returns a cache that stores a certificate for example.com
+// expiring at notAfter, and the ACME account key.
+func newAdminCache(t *testing.T, ctrl *gomock.Controller, notAfter time.Time) *SMCache {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	cert := testDomainCertPEM(t, key, "example.com", notAfter)
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		{Name: "projects/projId/secrets/example_com", CreateTime: timestamppb.New(created), Labels: managedLabels()},
+		{Name: "projects/projId/secrets/acme_account_key", CreateTime: timestamppb.New(created), Labels: managedLabels()},
+		{Name: "projects/projId/secrets/gone_example", CreateTime: timestamppb.New(created), Labels: managedLabels()},
+	}})
+	m.EXPECT().GetSecretVersion(gomock.Any()).DoAndReturn(
+		func(req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+			if req.GetName() == "projects/projId/secrets/gone_example/versions/latest" {
+				return nil, status.Error(codes.NotFound, "no versions")
+			}
+
+			return &secretmanagerpb.SecretVersion{
+				Name:       fmt.Sprintf("%v/versions/3", req.GetName()[:len(req.GetName())-len("/versions/latest")]),
+				State:      secretmanagerpb.SecretVersion_ENABLED,
+				CreateTime: timestamppb.New(created.Add(time.Hour)),
+			}, nil
+		}).MinTimes(2).MaxTimes(3)
+	m.EXPECT().AccessSecretVersion(gomock.Eq(&secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/projId/secrets/example_com/versions/latest",
+	})).Return(&secretmanagerpb.AccessSecretVersionResponse{Payload: checksummed(cert)}, nil)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{
+		ProjectID:    "projId",
+		AccountKey:   &KeyPolicy{ReadOnly: true},
+		DebugLogging: debug,
+	}, m)
+
+	// Recorded in RecentErrors.
+	err = cache.Put(context.Background(), "acme_account+key", []byte("key"))
+	assert.True(t, errors.Is(err, ErrReadOnly), err)
+
+	return cache
+}
+
+func TestAdminHandler_json(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second).UTC()
+	cache := newAdminCache(t, ctrl, notAfter)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/smcache?format=json", nil)
+	rec := httptest.NewRecorder()
+	cache.AdminHandler(&AdminOptions{Authorize: func(*http.Request) error { return nil }}).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NotContains(t, rec.Body.String(), "PRIVATE KEY")
+
+	var report AdminReport
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Len(t, report.Shards, 1)
+
+	s := report.Shards[0]
+	assert.Equal(t, "projId", s.Config["ProjectID"])
+	assert.Equal(t, "Secret Manager", s.Config["Backend"])
+	assert.Empty(t, s.KeysError)
+	assert.Len(t, s.Keys, 3)
+
+	assert.Equal(t, "example.com", s.Keys[0].Key)
+	assert.Equal(t, "projects/projId/secrets/example_com/versions/3", s.Keys[0].LatestVersion)
+	assert.Equal(t, "enabled", s.Keys[0].VersionState)
+	assert.Equal(t, notAfter, s.Keys[0].CertNotAfter)
+
+	assert.Equal(t, "acme_account+key", s.Keys[1].Key)
+	assert.True(t, s.Keys[1].CertNotAfter.IsZero())
+	assert.Empty(t, s.Keys[1].Error)
+
+	assert.Equal(t, "gone.example", s.Keys[2].Key)
+	assert.Empty(t, s.Keys[2].LatestVersion)
+
+	assert.Len(t, s.Errors, 1)
+	assert.Equal(t, OpPut, s.Errors[0].Op)
+	assert.Equal(t, "acme_account+key", s.Errors[0].Key)
+}
+
+func TestAdminHandler_html(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cache := newAdminCache(t, ctrl, time.Now().Add(time.Hour))
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/smcache", nil)
+	req.RemoteAddr = "127.0.0.1:4321"
+	rec := httptest.NewRecorder()
+	cache.AdminHandler(&AdminOptions{MaxKeys: 2}).ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, body, "<td>example.com</td>")
+	assert.Contains(t, body, "More keys are not shown.")
+	assert.Contains(t, body, "key is read-only")
+	assert.NotContains(t, body, "PRIVATE KEY")
+}
+
+func TestAdminHandler_forbidden(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId"})
+
+	for _, opts := range []*AdminOptions{
+		nil,
+		{Authorize: func(*http.Request) error { return errors.New("no token") }},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/debug/smcache", nil)
+		rec := httptest.NewRecorder()
+		cache.AdminHandler(opts).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestAdminHandler_backend(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	cache := NewSMCache(Config{ProjectID: "projId", Backend: NewMemoryBackend()})
+	assert.Nil(t, cache.Put(context.Background(), "example.com", testDomainCertPEM(t, key, "example.com", notAfter)))
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/smcache", nil)
+	req.Header.Set("Accept", "application/json")
+	req.RemoteAddr = "[::1]:4321"
+	rec := httptest.NewRecorder()
+	cache.AdminHandler(nil).ServeHTTP(rec, req)
+
+	var report AdminReport
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "*smcache.MemoryBackend", report.Shards[0].Config["Backend"])
+	assert.Empty(t, report.Shards[0].KeysError)
+	assert.Len(t, report.Shards[0].Keys, 1)
+
+	k := report.Shards[0].Keys[0]
+	assert.Equal(t, "example.com", k.Key)
+	assert.Equal(t, "projects/projId/secrets/example_com/versions/1", k.LatestVersion)
+	assert.Equal(t, "enabled", k.VersionState)
+	assert.Equal(t, notAfter, k.CertNotAfter)
+}
+
+func TestErrorLog_recent(t *testing.T) {
+	var l errorLog
+
+	for i := 0; i < maxRecentErrors+5; i++ {
+		l.add(OpGet, fmt.Sprint(i), errors.New("failed"))
+	}
+
+	recent := l.recent()
+	assert.Len(t, recent, maxRecentErrors)
+	assert.Equal(t, fmt.Sprint(maxRecentErrors+4), recent[0].Key)
+	assert.Equal(t, "5", recent[maxRecentErrors-1].Key)
+}
@@ -0,0 +1,361 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jwendel/smcache/internal/api"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ErrNotFound is returned by a BackendConn for a secret or version that does
+// not exist, or (from AccessLatest) whose latest version is not enabled.
+var ErrNotFound = errors.New("smcache: not found")
+
+// Backend is the versioned key-value store that Get, Put and Delete keep
+// autocert's data in. Secrets are named by the full resource names SMCache
+// builds from its Config, such as "projects/my-project-1234/secrets/example_com",
+// which a Backend may treat as opaque strings. See Config.Backend.
+type Backend interface {
+	// Open starts one operation, such as a Get, Put or GC, which closes the
+	// BackendConn once done. ctx applies to every call made through the BackendConn.
+	Open(ctx context.Context) (BackendConn, error)
+}
+
+// BackendConn makes the calls of one operation on a Backend. AdminHandler makes
+// calls on one BackendConn concurrently.
+type BackendConn interface {
+	// AccessLatest returns the data of the latest version of the secret, and
+	// that version's name.
+	AccessLatest(secret string) (data []byte, version string, err error)
+
+	// LatestVersion describes the latest version of the secret, whatever its state.
+	LatestVersion(secret string) (Version, error)
+
+	// ListVersions returns the versions of the secret, newest first. If listing
+	// fails part way through, it returns the versions read so far with the error.
+	ListVersions(secret string) ([]Version, error)
+
+	// CreateSecret creates an empty secret.
+	CreateSecret(secret string, opts SecretOptions) error
+
+	// AddVersion stores data as the new latest version of an existing secret,
+	// and returns the name of the version.
+	AddVersion(secret string, data []byte) (version string, err error)
+
+	// DestroyVersion irreversibly deletes the data of a version.
+	DestroyVersion(version string) error
+
+	// DisableVersion makes a version unreadable, until it's enabled again.
+	DisableVersion(version string) error
+
+	// DeleteSecret deletes a secret and all of its versions.
+	DeleteSecret(secret string) error
+
+	Close() error
+}
+
+// BackendLister is implemented by a BackendConn that can list secrets. Entries,
+// Keys, Prewarm, GC and AdminHandler need it when Config.Backend is set.
+// MemoryBackend implements it.
+type BackendLister interface {
+	// ListSecrets returns the secrets in parent (such as "projects/my-project-1234")
+	// whose IDs start with prefix, and which have every one of labels.
+	ListSecrets(parent, prefix string, labels map[string]string) ([]SecretInfo, error)
+}
+
+// SecretInfo describes one secret listed by a BackendLister.
+type SecretInfo struct {
+	// Name is the full name of the secret.
+	Name string
+	// Labels are the SecretOptions.Labels the secret was created with.
+	Labels map[string]string
+	// CreateTime is when the secret was created.
+	CreateTime time.Time
+	// ExpireTime is when the secret will be deleted, or the zero Time if it
+	// does not expire.
+	ExpireTime time.Time
+}
+
+// VersionState is the state of a Version.
+type VersionState int
+
+const (
+	VersionEnabled VersionState = iota
+	VersionDisabled
+	VersionDestroyed
+)
+
+// String returns "enabled", "disabled" or "destroyed".
+func (s VersionState) String() string {
+	switch s {
+	case VersionEnabled:
+		return "enabled"
+	case VersionDisabled:
+		return "disabled"
+	case VersionDestroyed:
+		return "destroyed"
+	default:
+		return fmt.Sprintf("VersionState(%d)", int(s))
+	}
+}
+
+// Version describes one version of a secret in a Backend.
+type Version struct {
+	Name       string
+	State      VersionState
+	CreateTime time.Time
+
+	// Etag changes whenever the version does, such as when it is disabled
+	// and enabled again. Backends that don't track changes leave it empty.
+	Etag string
+}
+
+// SecretOptions are applied to the secrets Put creates.
+type SecretOptions struct {
+	// Labels are Config.Labels.
+	Labels map[string]string
+
+	// Topics are Config.Topics.
+	Topics []string
+
+	// KMSKeyName is the Cloud KMS key of the key's KeyPolicy.
+	KMSKeyName string
+
+	// TTL is how long the secret lives before it is deleted, or 0 for ever.
+	TTL time.Duration
+}
+
+// backend returns Config.Backend, applying ReadLimit and WriteLimit to it, or
+// Secret Manager if it's nil.
+func (smc *SMCache) backend() Backend {
+	if smc.Backend == nil {
+		return secretManagerBackend{smc}
+	}
+
+	reads, writes := smc.limiters()
+	if reads == nil && writes == nil {
+		return smc.Backend
+	}
+
+	return limitedBackend{Backend: smc.Backend, reads: reads, writes: writes}
+}
+
+// listSecrets lists secrets through conn, if it is a BackendLister.
+func listSecrets(conn BackendConn, parent, prefix string, labels map[string]string) ([]SecretInfo, error) {
+	lister, ok := conn.(BackendLister)
+	if !ok {
+		return nil, errors.New("listing secrets requires a Config.Backend that implements BackendLister")
+	}
+
+	return lister.ListSecrets(parent, prefix, labels)
+}
+
+// requireSecretManager fails features that only work with Secret Manager if
+// Config.Backend is set.
+func (smc *SMCache) requireSecretManager(feature string) error {
+	if smc.Backend != nil {
+		return fmt.Errorf("%v requires the Secret Manager backend, but Config.Backend is set", feature)
+	}
+
+	return nil
+}
+
+// secretManagerBackend is the Backend used when Config.Backend is nil.
+type secretManagerBackend struct {
+	smc *SMCache
+}
+
+func (b secretManagerBackend) Open(ctx context.Context) (BackendConn, error) {
+	client, err := b.smc.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return secretManagerConn{client: client, location: b.smc.Location}, nil
+}
+
+// secretManagerConn is a BackendConn over one SecretClient.
+type secretManagerConn struct {
+	client   api.SecretClient
+	location string
+}
+
+func (c secretManagerConn) AccessLatest(secret string) ([]byte, string, error) {
+	svKey := secret + "/versions/latest"
+
+	resp, err := c.client.AccessSecretVersion(&secretmanagerpb.AccessSecretVersionRequest{Name: svKey})
+	if status.Code(err) == codes.FailedPrecondition && c.latestDeleted(secret) {
+		// The latest version is disabled or destroyed, see Config.DeleteMode.
+		return nil, "", fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+
+	if err != nil {
+		return nil, "", notFound(err)
+	}
+
+	data, err := verifyPayload(resp.GetPayload())
+	if err != nil {
+		return nil, "", fmt.Errorf("problem reading secret [%v]. %w", svKey, err)
+	}
+
+	return data, resp.GetName(), nil
+}
+
+func (c secretManagerConn) ListVersions(secret string) ([]Version, error) {
+	svi := c.client.ListSecretVersions(&secretmanagerpb.ListSecretVersionsRequest{
+		Parent: secret,
+		// Hopefully they are returned in most-recent-first order.
+		PageSize: listPageSize,
+	})
+
+	var versions []Version
+
+	for {
+		sv, err := svi.Next()
+		if errors.Is(err, iterator.Done) || (err == nil && sv == nil) {
+			return versions, nil
+		}
+
+		if err != nil {
+			return versions, notFound(err)
+		}
+
+		versions = append(versions, versionOf(sv))
+	}
+}
+
+func (c secretManagerConn) LatestVersion(secret string) (Version, error) {
+	sv, err := c.client.GetSecretVersion(&secretmanagerpb.GetSecretVersionRequest{Name: secret + "/versions/latest"})
+	if err != nil {
+		return Version{}, notFound(err)
+	}
+
+	return versionOf(sv), nil
+}
+
+// latestDeleted reports whether the latest version of secret is disabled or
+// destroyed. Secret Manager also fails with FailedPrecondition when the secret's
+// KMS key can't be used, which must not be mistaken for a missing secret.
+func (c secretManagerConn) latestDeleted(secret string) bool {
+	v, err := c.LatestVersion(secret)
+	return err == nil && v.State != VersionEnabled
+}
+
+// versionOf describes a SecretVersion.
+func versionOf(sv *secretmanagerpb.SecretVersion) Version {
+	v := Version{Name: sv.GetName(), Etag: sv.GetEtag()}
+
+	switch sv.GetState() {
+	case secretmanagerpb.SecretVersion_ENABLED:
+		v.State = VersionEnabled
+	case secretmanagerpb.SecretVersion_DISABLED:
+		v.State = VersionDisabled
+	default:
+		v.State = VersionDestroyed
+	}
+
+	if ct := sv.GetCreateTime(); ct != nil {
+		v.CreateTime = ct.AsTime()
+	}
+
+	return v
+}
+
+func (c secretManagerConn) CreateSecret(secret string, opts SecretOptions) error {
+	parent, id, _ := strings.Cut(secret, "/secrets/")
+	req := &secretmanagerpb.CreateSecretRequest{
+		Parent:   parent,
+		SecretId: id,
+		Secret:   &secretmanagerpb.Secret{},
+	}
+
+	// Regional secrets live in a single location, and must not set a replication policy.
+	if c.location == "" {
+		automatic := &secretmanagerpb.Replication_Automatic{}
+		if opts.KMSKeyName != "" {
+			automatic.CustomerManagedEncryption = &secretmanagerpb.CustomerManagedEncryption{
+				KmsKeyName: opts.KMSKeyName,
+			}
+		}
+
+		req.Secret.Replication = &secretmanagerpb.Replication{
+			Replication: &secretmanagerpb.Replication_Automatic_{
+				Automatic: automatic,
+			},
+		}
+	}
+
+	if len(opts.Labels) > 0 {
+		req.Secret.Labels = opts.Labels
+	}
+
+	for _, t := range opts.Topics {
+		req.Secret.Topics = append(req.Secret.Topics, &secretmanagerpb.Topic{Name: t})
+	}
+
+	if opts.TTL > 0 {
+		req.Secret.Expiration = &secretmanagerpb.Secret_Ttl{Ttl: durationpb.New(opts.TTL)}
+	}
+
+	_, err := c.client.CreateSecret(req)
+
+	return err
+}
+
+func (c secretManagerConn) AddVersion(secret string, data []byte) (string, error) {
+	sv, err := c.client.AddSecretVersion(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secret,
+		Payload: newPayload(data),
+	})
+
+	return sv.GetName(), err
+}
+
+func (c secretManagerConn) DestroyVersion(version string) error {
+	_, err := c.client.DestroySecretVersion(&secretmanagerpb.DestroySecretVersionRequest{Name: version})
+	return err
+}
+
+func (c secretManagerConn) DisableVersion(version string) error {
+	_, err := c.client.DisableSecretVersion(&secretmanagerpb.DisableSecretVersionRequest{Name: version})
+	return err
+}
+
+func (c secretManagerConn) DeleteSecret(secret string) error {
+	return notFound(c.client.DeleteSecret(&secretmanagerpb.DeleteSecretRequest{Name: secret}))
+}
+
+func (c secretManagerConn) Close() error {
+	return c.client.Close()
+}
+
+// notFound wraps Secret Manager's NotFound errors in ErrNotFound.
+func notFound(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+
+	return err
+}
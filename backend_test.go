@@ -0,0 +1,212 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/api/iterator"
+)
+
+func TestMemoryBackend_roundTrip(t *testing.T) {
+	mem := NewMemoryBackend()
+	cache := NewSMCache(Config{ProjectID: "projId", Labels: map[string]string{"app": "web"}, Backend: mem, DebugLogging: debug})
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert 1")))
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert 2")))
+
+	data, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("cert 2"), data)
+
+	secret := "projects/projId/secrets/example_com"
+	versions, err := mem.ListVersions(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, []Version{
+		{Name: secret + "/versions/2", State: VersionEnabled},
+		{Name: secret + "/versions/1", State: VersionDestroyed},
+	}, states(versions))
+
+	opts, err := mem.Options(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"app": "web", managedLabel: managedLabelValue}, opts.Labels)
+
+	assert.Nil(t, cache.Delete(ctx, "example.com"))
+	assert.Nil(t, cache.Delete(ctx, "example.com"))
+
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestMemoryBackend_deleteModes(t *testing.T) {
+	for _, mode := range []DeleteMode{DeleteModeDestroyVersions, DeleteModeDisableVersions} {
+		mem := NewMemoryBackend()
+		cache := NewSMCache(Config{ProjectID: "projId", DeleteMode: mode, Backend: mem, DebugLogging: debug})
+		ctx := context.Background()
+
+		assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+		assert.Nil(t, cache.Delete(ctx, "example.com"), mode)
+
+		_, err := cache.Get(ctx, "example.com")
+		assert.Equal(t, autocert.ErrCacheMiss, err, mode)
+
+		want := VersionDestroyed
+		if mode == DeleteModeDisableVersions {
+			want = VersionDisabled
+		}
+
+		versions, err := mem.ListVersions("projects/projId/secrets/example_com")
+		assert.Nil(t, err, mode)
+		assert.Equal(t, []Version{{Name: "projects/projId/secrets/example_com/versions/1", State: want}}, states(versions), mode)
+
+		// The next Put destroys the deleted version, whatever its state.
+		assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert2")))
+
+		versions, err = mem.ListVersions("projects/projId/secrets/example_com")
+		assert.Nil(t, err, mode)
+		assert.Equal(t, []Version{
+			{Name: "projects/projId/secrets/example_com/versions/2", State: VersionEnabled},
+			{Name: "projects/projId/secrets/example_com/versions/1", State: VersionDestroyed},
+		}, states(versions), mode)
+	}
+}
+
+func TestMemoryBackend_ttl(t *testing.T) {
+	mem := NewMemoryBackend()
+	secret := "projects/projId/secrets/token"
+
+	assert.Nil(t, mem.CreateSecret(secret, SecretOptions{TTL: time.Millisecond}))
+	_, err := mem.AddVersion(secret, []byte("token"))
+	assert.Nil(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, err = mem.AccessLatest(secret)
+	assert.True(t, errors.Is(err, ErrNotFound), err)
+}
+
+func TestMemoryBackend_noProjectID(t *testing.T) {
+	cache := NewSMCache(Config{Backend: NewMemoryBackend(), DebugLogging: debug})
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+
+	data, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("cert"), data)
+}
+
+func TestBackend_secretManagerOnly(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId", Backend: NewMemoryBackend(), DebugLogging: debug})
+	ctx := context.Background()
+	want := "requires the Secret Manager backend, but Config.Backend is set"
+
+	_, err := cache.Preflight(ctx)
+	assert.ErrorContains(t, err, want)
+
+	_, err = cache.SweepHTTPTokens(ctx)
+	assert.ErrorContains(t, err, want)
+
+	assert.ErrorContains(t, cache.Subscribe(ctx, nil, nil), want)
+}
+
+func TestMemoryBackend_list(t *testing.T) {
+	mem := NewMemoryBackend()
+	cache := NewSMCache(Config{ProjectID: "projId", SecretPrefix: "certs-", Backend: mem, DebugLogging: debug})
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+	assert.Nil(t, cache.Put(ctx, "old.example", []byte("cert")))
+	assert.Nil(t, mem.CreateSecret("projects/projId/secrets/db_password", SecretOptions{}))
+
+	var keys []string
+
+	it := cache.Keys(ctx, nil)
+	for {
+		key, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		assert.Nil(t, err)
+		keys = append(keys, key)
+	}
+
+	assert.Equal(t, []string{"example.com", "old.example"}, keys)
+
+	records, err := cache.GC(ctx, GCOptions{HostPolicy: autocert.HostWhitelist("example.com")})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "old.example", records[0].Key)
+
+	_, err = mem.ListVersions("projects/projId/secrets/certs-old_example")
+	assert.True(t, errors.Is(err, ErrNotFound), err)
+}
+
+// unlistedBackend is a Backend whose connections can't list secrets.
+type unlistedBackend struct {
+	mem *MemoryBackend
+}
+
+func (b unlistedBackend) Open(ctx context.Context) (BackendConn, error) {
+	return struct{ BackendConn }{b.mem}, nil
+}
+
+func TestBackend_notLister(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId", Backend: unlistedBackend{NewMemoryBackend()}, DebugLogging: debug})
+
+	_, err := cache.Keys(context.Background(), nil).Next()
+	assert.EqualError(t, err, "failed to list secrets. listing secrets requires a Config.Backend that implements BackendLister")
+}
+
+func TestBackend_limits(t *testing.T) {
+	cache := NewSMCache(Config{
+		ProjectID:    "projId",
+		Backend:      NewMemoryBackend(),
+		WriteLimit:   Limit{PerSecond: 0.001},
+		Timeout:      20 * time.Millisecond,
+		DebugLogging: debug,
+	})
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Delete(ctx, "example.com"))
+
+	// The write budget is spent, but reads have their own.
+	err := cache.Delete(ctx, "example.com")
+	assert.EqualError(t, err, "problem while deleting secret [projects/projId/secrets/example_com]. "+
+		"waiting to delete secret: context deadline exceeded")
+
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+// states drops the create times of versions, which tests can't predict.
+func states(versions []Version) []Version {
+	out := make([]Version, len(versions))
+	for i, v := range versions {
+		out[i] = Version{Name: v.Name, State: v.State}
+	}
+
+	return out
+}
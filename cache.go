@@ -16,26 +16,39 @@ package smcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jwendel/smcache/internal/api"
 	"golang.org/x/crypto/acme/autocert"
-	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"golang.org/x/sync/singleflight"
 )
 
+var _ autocert.Cache = (*SMCache)(nil)
+
 // Config is passed into NewSMCache as a way to configure how SMCache will behave
 // through it's lifespan.
 type Config struct {
 	// ProjectID is the GCP Project ID where the Secrets will be stored.
 	// This is the "Project ID" as seen in Google Cloud console.
 	// Example ID: "my-project-1234".
-	// This field is Required.
+	// Optional. If empty, it is detected on first use from the application
+	// default credentials, then the GCE/Cloud Run metadata server (or
+	// GCE_METADATA_HOST), then the GOOGLE_CLOUD_PROJECT environment variable.
+	// The detected ID is used without changing this field.
 	ProjectID string
 
+	// Location is the GCP region the Secrets will be stored in, such as "us-central1".
+	// If set, smcache uses regional secrets (projects/*/locations/*/secrets/*)
+	// and talks to that region's Secret Manager endpoint.
+	// Optional, defaults to global secrets with automatic replication.
+	Location string
+
 	// SecretPrefix is a string that will be put before the secret name.
 	// This is useful for for IAM access control. As well, it's useful
 	// for grouping secrets by application.
@@ -48,6 +61,125 @@ type Config struct {
 	// Optional, defaults to false.
 	KeepOldCertificates bool
 
+	// KMSKeyName is the Cloud KMS key used to encrypt secrets that smcache creates,
+	// such as "projects/p/locations/global/keyRings/r/cryptoKeys/k".
+	// This is not supported along with Location.
+	// Optional, defaults to Google-managed encryption.
+	KMSKeyName string
+
+	// AccountKey, if set, is the policy for the ACME account's private key
+	// ("acme_account+key"). Anyone that can read this key can act as the ACME
+	// account, so it can be kept in a different project or prefix, with its own
+	// encryption and retention, and made read-only.
+	// Optional, defaults to storing it like every certificate.
+	AccountKey *KeyPolicy
+
+	// HTTPTokenTTL is how long the secret holding an http-01 challenge token
+	// ("<token>+http-01") lives before Secret Manager deletes it, in case autocert
+	// never does. See also SweepHTTPTokens.
+	// Optional, defaults to 1 hour.
+	HTTPTokenTTL time.Duration
+
+	// If true, http-01 challenge tokens are also kept in memory for HTTPTokenTTL,
+	// so this process answers challenges it started without calling Secret Manager.
+	// Other replicas still read the tokens from Secret Manager.
+	// Optional, defaults to false.
+	HTTPTokenMemoryCache bool
+
+	// MissCacheTTL is how long Get remembers that a key was not found, and returns
+	// autocert.ErrCacheMiss for it without calling Secret Manager. This saves quota
+	// when clients send server names that were never stored. Put and Delete of a key
+	// clear its remembered miss, but a secret created by another replica is not seen
+	// until the TTL ends (or Evict is called, as Subscribe does). At most 10000
+	// misses are remembered.
+	// Optional, defaults to 0, which does not remember misses.
+	MissCacheTTL time.Duration
+
+	// MaxStaleness is how long Get keeps serving the last value it read for a key
+	// while Secret Manager fails with transient errors (such as Unavailable), instead
+	// of failing the TLS handshake. Stale values are refreshed in the background, and
+	// Stats reports how stale the values being served are.
+	// Optional, defaults to 0, which never serves stale values.
+	MaxStaleness time.Duration
+
+	// If true, Put only journals the data and returns, and a background worker
+	// writes it to Secret Manager, retrying until it succeeds or fails permanently
+	// (for example with PermissionDenied), when it is dropped and recorded in
+	// RecentErrors. This keeps Secret Manager calls out of autocert's issuance path.
+	// Get returns queued data straight away, but other replicas only see it once
+	// written. Call Flush and then Close before the process exits.
+	// Optional, defaults to false.
+	WriteBehind bool
+
+	// JournalDir is a local directory where WriteBehind keeps queued Puts, so they
+	// are written after a restart. Its files hold private keys, unencrypted.
+	// Optional, defaults to keeping queued Puts in memory only.
+	JournalDir string
+
+	// Labels are set on every secret smcache creates, and can be used to filter
+	// Keys and Entries, or in IAM conditions.
+	// Optional, defaults to no labels.
+	Labels map[string]string
+
+	// If true, Put compresses data with gzip before storing it. Get can read both
+	// compressed and uncompressed data whatever this is set to, so it can be
+	// turned on (or off) for existing secrets.
+	// Optional, defaults to false.
+	Compress bool
+
+	// If true, Put stores data in a versioned envelope that records how it was
+	// encoded, along with the original key, the writer's hostname and when it was
+	// written. See OpenEnvelope for the format. Get reads enveloped and plain data
+	// alike, so this can be turned on for existing secrets.
+	// Optional, defaults to false.
+	Envelope bool
+
+	// Topics are the Pub/Sub topics, such as "projects/my-project-1234/topics/certs",
+	// that Secret Manager publishes changes to. They are only set on secrets when
+	// smcache creates them. See Subscribe.
+	// Optional, defaults to no topics.
+	Topics []string
+
+	// DeleteMode chooses what Delete does to a key's secret: delete it
+	// (DeleteModeSecret), destroy its versions but keep the secret's labels and IAM
+	// bindings (DeleteModeDestroyVersions), or disable its versions so the delete
+	// can be undone (DeleteModeDisableVersions). Get reports keys whose latest
+	// version is destroyed or disabled as autocert.ErrCacheMiss.
+	// Optional, defaults to DeleteModeSecret.
+	DeleteMode DeleteMode
+
+	// ReadLimit caps the rate and concurrency of calls that read from Secret
+	// Manager (accessing, getting and listing secrets and versions), and
+	// WriteLimit those that change it. Calls wait for their turn, up to Timeout.
+	// The limits apply to this SMCache only, so divide the project's quota by the
+	// number of replicas.
+	// Optional, defaults to no limits.
+	ReadLimit  Limit
+	WriteLimit Limit
+
+	// Backend is the store Get, Put and Delete keep data in, for example
+	// NewMemoryBackend() in tests. ReadLimit and WriteLimit apply to it too.
+	// Entries, Keys, Prewarm, GC and AdminHandler's key listing need it to
+	// implement BackendLister. Subscribe, SweepHTTPTokens and Preflight only work
+	// with Secret Manager, and fail if it's set.
+	// Optional, defaults to Secret Manager.
+	Backend Backend
+
+	// Hooks are called around Get, Put and Delete, for example to keep an audit
+	// trail or to push a new certificate elsewhere after Put. They can't be set
+	// from the environment or a config file.
+	// Optional, defaults to no hooks.
+	Hooks Hooks
+
+	// WatchInterval is how often Watch polls Secret Manager for changes.
+	// Optional, defaults to 1 minute.
+	WatchInterval time.Duration
+
+	// Timeout bounds how long each Get, Put and Delete may take, including
+	// every Secret Manager call it makes.
+	// Optional, defaults to no timeout beyond the context passed in.
+	Timeout time.Duration
+
 	// DebugLogging controls if logging is enabled.
 	// If true, smcache will log some status messages to log.Prtinf().
 	// This will not logany sensitive data, it should just be key
@@ -56,55 +188,187 @@ type Config struct {
 	DebugLogging bool
 }
 
-// smCache is the struct that will implement the autocert.Cache interface.
+// SMCache is the struct that implements the autocert.Cache interface.
 // It stores the needed data to interact with the GCP SecretManager.
-type smCache struct {
+// Use NewSMCache to create one.
+type SMCache struct {
 	Config
 	cf api.ClientFactory
+
+	// projectMu serialises detecting the ProjectID, and guards projectErr and
+	// projectErrAt, the last failure to. The Config is never changed, the ID
+	// found is kept in detectedProjectID instead. See resolveProjectID.
+	projectMu         sync.Mutex
+	projectErr        error
+	projectErrAt      time.Time
+	detectedProjectID atomic.Value // string
+
+	// tokens holds http-01 challenge tokens if HTTPTokenMemoryCache is set.
+	tokens tokenCache
+
+	// stale holds the last good value of each key, if MaxStaleness is set.
+	stale staleCache
+
+	// misses holds keys recently found missing, if MissCacheTTL is set.
+	misses missCache
+
+	// queue holds Puts waiting to be written, if WriteBehind is set.
+	queue writeQueue
+
+	// reads and writes apply ReadLimit and WriteLimit, see newClient.
+	limitersOnce  sync.Once
+	reads, writes *limiter
+
+	// gets collapses concurrent Gets of the same sanitized key into one call.
+	gets singleflight.Group
+
+	// errs holds the most recent errors, for AdminHandler.
+	errs errorLog
 }
 
-// NewSMCache creates a struct that implements the `autocert.Cache` interface.
+// NewSMCache creates an SMCache, which implements the `autocert.Cache` interface.
 // It uses the Config passed in to drive the behavior of this client.
-func NewSMCache(config Config) autocert.Cache {
+func NewSMCache(config Config) *SMCache {
 	config.SecretPrefix = sanitize(config.SecretPrefix)
 
-	return &smCache{
+	if config.AccountKey != nil {
+		// Copy, so the caller's KeyPolicy is not changed by sanitizing.
+		ak := *config.AccountKey
+		ak.SecretPrefix = sanitize(ak.SecretPrefix)
+		config.AccountKey = &ak
+	}
+
+	return &SMCache{
 		Config: config,
-		cf:     &api.SecretClientFactoryImpl{},
+		cf:     &api.SecretClientFactoryImpl{Location: config.Location},
 	}
 }
 
 // Get returns a certificate data for the specified key.
 // If there's no such key, Get returns ErrCacheMiss.
-func (smc *smCache) Get(ctx context.Context, key string) ([]byte, error) {
-	key = sanitize(key)
+func (smc *SMCache) Get(ctx context.Context, key string) ([]byte, error) {
+	info, err := smc.before(ctx, OpGet, key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	data, versionName, err := smc.read(ctx, sanitize(key))
+	info.VersionName = versionName
+	smc.after(ctx, info, err)
+
+	return data, err
+}
+
+// read returns the data of the sanitized key, and the name of the SecretVersion
+// it was read from, if it was read from Secret Manager.
+func (smc *SMCache) read(ctx context.Context, key string) ([]byte, string, error) {
 	smc.logf("GET called for: [%v]", key)
 
-	client, err := smc.cf.NewSecretClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to setup client: %w", err)
+	if smc.HTTPTokenMemoryCache && isHTTPToken(key) {
+		if data, ok := smc.tokens.get(key); ok {
+			smc.logf("GET: found http-01 token in memory")
+			return data, "", nil
+		}
 	}
-	defer client.Close()
 
-	svKey := fmt.Sprintf("projects/%s/secrets/%s%s/versions/latest", smc.ProjectID, smc.SecretPrefix, key)
-	smc.logf("GET svKey: %v", svKey)
+	if data, ok := smc.queued(key); ok {
+		smc.logf("GET: found queued PUT")
+		return data, "", nil
+	}
+
+	if smc.MissCacheTTL > 0 && smc.misses.has(key) {
+		smc.logf("GET: remembered miss")
+		return nil, "", autocert.ErrCacheMiss
+	}
 
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: svKey,
+	// While Secret Manager is failing for the key, don't wait for it to fail again.
+	if data, ok := smc.serveStale(key, true); ok {
+		return data, "", nil
 	}
-	resp, err := client.AccessSecretVersion(req)
 
-	if st := status.Convert(err); st != nil {
-		if st.Code() == codes.NotFound {
-			return nil, autocert.ErrCacheMiss
+	// Concurrent Gets for the same key share one call to Secret Manager. The shared
+	// call is not cancelled with any one caller's ctx (only Config.Timeout bounds it),
+	// while each caller still returns as soon as its own ctx is done.
+	ch := smc.gets.DoChan(key, func() (interface{}, error) {
+		return smc.get(context.WithoutCancel(ctx), key)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			if isTransient(res.Err) {
+				if data, ok := smc.serveStale(key, false); ok {
+					return data, "", nil
+				}
+			}
+
+			return nil, "", res.Err
 		}
 
-		return nil, err
+		v := res.Val.(secretData)
+		if res.Shared {
+			// Callers own what they are given, so don't let them share one slice.
+			v.data = append([]byte(nil), v.data...)
+		}
+
+		return v.data, v.versionName, nil
+	}
+}
+
+// secretData is the data read from a SecretVersion.
+type secretData struct {
+	data        []byte
+	versionName string
+}
+
+// get reads the latest version of the secret for the sanitized key.
+func (smc *SMCache) get(ctx context.Context, key string) (secretData, error) {
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return secretData{}, err
+	}
+
+	conn, err := smc.backend().Open(ctx)
+	if err != nil {
+		return secretData{}, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer conn.Close()
+
+	marker := smc.misses.since()
+	sKey := smc.secretName(key)
+	smc.logf("GET secret: %v", sKey)
+
+	stored, versionName, err := conn.AccessLatest(sKey)
+	if errors.Is(err, ErrNotFound) {
+		smc.stale.remove(key)
+
+		if smc.MissCacheTTL > 0 {
+			smc.misses.add(key, smc.MissCacheTTL, marker)
+		}
+
+		return secretData{}, autocert.ErrCacheMiss
 	}
 
-	smc.logf("GET: Got result: %+v", resp.GetName())
+	if err != nil {
+		return secretData{}, err
+	}
+
+	smc.logf("GET: Got result: %+v", versionName)
 
-	return resp.GetPayload().GetData(), nil
+	data, err := decodePayload(stored)
+	if err != nil {
+		return secretData{}, fmt.Errorf("problem reading secret [%v]. %w", versionName, err)
+	}
+
+	if smc.MaxStaleness > 0 {
+		smc.stale.put(key, data)
+	}
+
+	return secretData{data: data, versionName: versionName}, nil
 }
 
 // Only get the 10 most recent SecretVersions to delete for this secret.
@@ -113,150 +377,195 @@ const listPageSize = 10
 // Put stores the data in the cache under the specified key.
 // Underlying implementations may use any data storage format,
 // as long as the reverse operation, Get, results in the original data.
-func (smc *smCache) Put(ctx context.Context, key string, data []byte) error {
+func (smc *SMCache) Put(ctx context.Context, key string, data []byte) error {
+	info, err := smc.before(ctx, OpPut, key, "")
+	if err != nil {
+		return err
+	}
+
+	if smc.WriteBehind {
+		err = smc.enqueue(key, data)
+	} else {
+		info.VersionName, err = smc.put(ctx, key, data)
+	}
+
+	smc.after(ctx, info, err)
+
+	return err
+}
+
+// put writes data to Secret Manager as the latest version of key, and returns
+// the name of the SecretVersion it added.
+func (smc *SMCache) put(ctx context.Context, key string, data []byte) (string, error) {
+	payload, err := smc.encodePayload(key, data)
+	if err != nil {
+		return "", err
+	}
+
+	hookKey := key
 	key = sanitize(key)
 	smc.logf("PUT called for: [%v]", key)
 
-	client, err := smc.cf.NewSecretClient(ctx)
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return "", err
+	}
+
+	policy := smc.policyFor(key)
+	if policy.readOnly {
+		return "", fmt.Errorf("%w: cannot put [%v]", ErrReadOnly, key)
+	}
+
+	conn, err := smc.backend().Open(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to setup client: %w", err)
+		return "", fmt.Errorf("failed to setup client: %w", err)
 	}
-	defer client.Close()
+	defer conn.Close()
+
+	sKey := smc.secretName(key)
 
 	// Get a List of SecretVersions that already exist in this secret.
 	// If we get NotFound, we know to create the secret.
 	// Otherwise we'll have a list of SecretVersions to delete once the rest is complete.
-	svi := client.ListSecretVersions(&secretmanagerpb.ListSecretVersionsRequest{
-		Parent: fmt.Sprintf("projects/%s/secrets/%s%s", smc.ProjectID, smc.SecretPrefix, key),
-		// Should only need to get a few to delete.  Also hopefully they are returned in most-recent-first order
-		PageSize: listPageSize,
-	})
-
-	sv, err := svi.Next()
-	if st := status.Convert(err); st != nil {
-		if st.Code() == codes.NotFound {
-			// If the base Secret was NotFound, we attempt to create it
-			err = smc.createSecret(key, client)
-			if err != nil {
-				// Secret creation failed, bail
-				return err
-			}
-		} else {
-			// Some other error happened, lets just return
-			return err
+	versions, err := conn.ListVersions(sKey)
+	if errors.Is(err, ErrNotFound) {
+		// If the base Secret was NotFound, we attempt to create it
+		if err = conn.CreateSecret(sKey, smc.secretOptions(policy)); err != nil {
+			return "", fmt.Errorf("failed to create Secret. %w", err)
+		}
+	} else if err != nil {
+		if len(versions) == 0 {
+			return "", err
 		}
+
+		// Some versions were listed, so only the cleanup of old ones is cut short.
+		smc.logf("problem listing versions of [%v]. %v", sKey, err)
 	}
 
-	err = smc.addSecretVersion(key, data, client)
+	added, err := conn.AddVersion(sKey, payload)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if !smc.KeepOldCertificates {
-		smc.deleteOldSecretVersions(client, sv, svi)
+	// Gets that start from here on must not join one that may have read the old value,
+	// and a Get still in flight can't remember a miss once it's removed here.
+	smc.gets.Forget(key)
+	smc.misses.remove(key)
+
+	if smc.MaxStaleness > 0 {
+		smc.stale.put(key, data)
 	}
 
-	return nil
+	if !policy.keepOldVersions {
+		smc.deleteOldSecretVersions(ctx, conn, hookKey, versions)
+	}
+
+	if smc.HTTPTokenMemoryCache && isHTTPToken(key) {
+		smc.tokens.put(key, data, policy.ttl)
+	}
+
+	return added, nil
 }
 
-// deleteOldSecretVersions will delete sv and all other SecretVersions within the svi.
+// deleteOldSecretVersions will destroy all versions that aren't already destroyed,
+// including those disabled by DeleteModeDisableVersions.
 // This is a best effort operation and will not return any errors if there are problems,
 // but will log any problems (if debug logging is enabled).
-func (smc *smCache) deleteOldSecretVersions(
-	client api.SecretClient,
-	sv *secretmanagerpb.SecretVersion,
-	svi api.SecretListIterator) {
-	var err error
-
-	for {
-		if sv == nil {
-			return
+func (smc *SMCache) deleteOldSecretVersions(ctx context.Context, conn BackendConn, key string, versions []Version) {
+	for _, v := range versions {
+		if v.State == VersionDestroyed {
+			continue
 		}
 
-		// This code will only ever leave them in the "ENABLED" state,
-		// so just try to delete those.
-		if sv.GetState() == secretmanagerpb.SecretVersion_ENABLED {
-			svr := &secretmanagerpb.DestroySecretVersionRequest{
-				Name: sv.GetName(),
-			}
-
-			_, err = client.DestroySecretVersion(svr)
-			if err != nil {
-				smc.logf("Error deleting secret version: %v, got error %v", sv.GetName(), err)
-			} else {
-				smc.logf("Deleted secret %v", sv.GetName())
-			}
-		}
-		// Get the next SecretVersion to delete
-		sv, err = svi.Next()
-		if err != nil {
-			return
+		if err := smc.destroyVersion(ctx, conn, key, v.Name); err != nil {
+			smc.logf("Error deleting secret version: %v, got error %v", v.Name, err)
+		} else {
+			smc.logf("Deleted secret %v", v.Name)
 		}
 	}
 }
 
-// createSecret will create the secret within the project.
-func (smc *smCache) createSecret(key string, client api.SecretClient) error {
-	createSecretReq := &secretmanagerpb.CreateSecretRequest{
-		Parent:   fmt.Sprintf("projects/%s", smc.ProjectID),
-		SecretId: fmt.Sprintf("%s%s", smc.SecretPrefix, key),
-		Secret: &secretmanagerpb.Secret{
-			Replication: &secretmanagerpb.Replication{
-				Replication: &secretmanagerpb.Replication_Automatic_{
-					Automatic: &secretmanagerpb.Replication_Automatic{},
-				},
-			},
-		},
-	}
-
-	_, err := client.CreateSecret(createSecretReq)
-	if err != nil {
-		return fmt.Errorf("failed to create Secret. %w", err)
+// secretOptions are applied to the secrets created with this policy.
+func (smc *SMCache) secretOptions(policy keyPolicy) SecretOptions {
+	labels := make(map[string]string, len(smc.Labels)+1)
+	for k, v := range smc.Labels {
+		labels[k] = v
 	}
 
-	return nil
-}
+	labels[managedLabel] = managedLabelValue
 
-// addSecretVersion will store the data within the secret.
-func (smc *smCache) addSecretVersion(key string, data []byte, client api.SecretClient) error {
-	sKey := fmt.Sprintf("projects/%s/secrets/%s%s", smc.ProjectID, smc.SecretPrefix, key)
+	return SecretOptions{
+		Labels:     labels,
+		Topics:     smc.Topics,
+		KMSKeyName: policy.kmsKeyName,
+		TTL:        policy.ttl,
+	}
+}
 
-	req := &secretmanagerpb.AddSecretVersionRequest{
-		Parent: sKey,
-		Payload: &secretmanagerpb.SecretPayload{
-			Data: data,
-		},
+// Delete removes a certificate data from the cache under the specified key.
+// If there's no such key in the cache, Delete returns nil.
+func (smc *SMCache) Delete(ctx context.Context, key string) error {
+	info, err := smc.before(ctx, OpDelete, key, "")
+	if err != nil {
+		return err
 	}
 
-	_, err := client.AddSecretVersion(req)
+	err = smc.delete(ctx, key)
+	smc.after(ctx, info, err)
 
 	return err
 }
 
-// Delete removes a certificate data from the cache under the specified key.
-// If there's no such key in the cache, Delete returns nil.
-func (smc *smCache) Delete(ctx context.Context, key string) error {
+// delete removes key from Secret Manager, as chosen by DeleteMode.
+func (smc *SMCache) delete(ctx context.Context, key string) error {
+	hookKey := key
 	key = sanitize(key)
 	smc.logf("Delete called for: [%v]", key)
 
-	client, err := smc.cf.NewSecretClient(ctx)
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return err
+	}
+
+	if smc.policyFor(key).readOnly {
+		return fmt.Errorf("%w: cannot delete [%v]", ErrReadOnly, key)
+	}
+
+	// A queued Put must not recreate the secret after it's deleted.
+	release, err := smc.dequeue(key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	smc.tokens.remove(key)
+	smc.misses.remove(key)
+	smc.stale.remove(key)
+	defer smc.gets.Forget(key)
+
+	conn, err := smc.backend().Open(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to setup client: %w", err)
 	}
-	defer client.Close()
+	defer conn.Close()
 
-	sKey := fmt.Sprintf("projects/%s/secrets/%s%s", smc.ProjectID, smc.SecretPrefix, key)
+	sKey := smc.secretName(key)
 
-	req := &secretmanagerpb.DeleteSecretRequest{
-		Name: sKey,
+	if smc.DeleteMode == DeleteModeDestroyVersions || smc.DeleteMode == DeleteModeDisableVersions {
+		return smc.deleteVersions(ctx, conn, hookKey, sKey)
 	}
 
-	err = client.DeleteSecret(req)
-	if st := status.Convert(err); st != nil {
-		// No-such-key, we return nil
-		if st.Code() == codes.NotFound {
-			return nil
-		}
+	err = conn.DeleteSecret(sKey)
+	// No-such-key, we return nil
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
 		// Some other problem happened while trying to delete, return the error
 		return fmt.Errorf("problem while deleting secret [%v]. %w", sKey, err)
 	}
@@ -264,8 +573,33 @@ func (smc *smCache) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// withTimeout applies Config.Timeout to ctx, if one is set.
+func (smc *SMCache) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if smc.Timeout > 0 {
+		return context.WithTimeout(ctx, smc.Timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// secretsParent is the resource name that secrets with this policy are created within.
+func (smc *SMCache) secretsParent(policy keyPolicy) string {
+	if smc.Location != "" {
+		return fmt.Sprintf("projects/%s/locations/%s", policy.projectID, smc.Location)
+	}
+
+	return fmt.Sprintf("projects/%s", policy.projectID)
+}
+
+// secretName is the resource name of the secret that stores key.
+// key must already be sanitized.
+func (smc *SMCache) secretName(key string) string {
+	policy := smc.policyFor(key)
+	return fmt.Sprintf("%s/secrets/%s%s", smc.secretsParent(policy), policy.secretPrefix, key)
+}
+
 // logf to basic logger if DebugLogging is enabled.
-func (smc *smCache) logf(format string, v ...interface{}) {
+func (smc *SMCache) logf(format string, v ...interface{}) {
 	if smc.DebugLogging {
 		log.Printf("smcache: "+format, v...)
 	}
@@ -16,8 +16,13 @@ package smcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -85,6 +90,156 @@ func TestGet_happyPath(t *testing.T) {
 	assert.Equal(t, result, secret)
 }
 
+func TestGet_checksum(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("secret data!")
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{
+			Name:    "bd",
+			Payload: checksummed(secret),
+		}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", SecretPrefix: "b", DebugLogging: debug}, m)
+	result, err := cache.Get(context.Background(), "d")
+
+	assert.Nil(t, err)
+	assert.Equal(t, result, secret)
+}
+
+func TestGet_concurrent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	const callers = 20
+
+	secret := []byte("secret data!")
+	release := make(chan struct{})
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).DoAndReturn(
+		func(*secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+			<-release
+			return &secretmanagerpb.AccessSecretVersionResponse{Name: "bd", Payload: checksummed(secret)}, nil
+		}).Times(1)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", SecretPrefix: "b", DebugLogging: debug}, m)
+
+	var wg sync.WaitGroup
+	results := make([][]byte, callers)
+	errs := make([]error, callers)
+	ctx := waitCounter{Context: context.Background(), waiting: new(atomic.Int32)}
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = cache.Get(ctx, "d")
+		}(i)
+	}
+
+	// Wait for every caller to join the call in flight before it returns.
+	for ctx.waiting.Load() < callers {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		assert.Nil(t, errs[i])
+		assert.Equal(t, secret, results[i])
+	}
+
+	// Each caller gets its own copy of the data.
+	results[0][0] = 'S'
+	assert.Equal(t, secret, results[1])
+}
+
+// waitCounter is a context that counts the callers that have started waiting
+// on it. Get only waits on its ctx once it has joined the shared call.
+type waitCounter struct {
+	context.Context
+	waiting *atomic.Int32
+}
+
+func (c waitCounter) Done() <-chan struct{} {
+	c.waiting.Add(1)
+	return c.Context.Done()
+}
+
+func TestGet_concurrentCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("secret data!")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).DoAndReturn(
+		func(*secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+			close(started)
+			<-release
+			return &secretmanagerpb.AccessSecretVersionResponse{Name: "bd", Payload: checksummed(secret)}, nil
+		}).Times(1)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", SecretPrefix: "b", DebugLogging: debug}, m)
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	patient := make(chan result)
+
+	go func() {
+		data, err := cache.Get(context.Background(), "d")
+		patient <- result{data, err}
+	}()
+
+	<-started
+
+	// A caller that gives up returns straight away, without cancelling the shared call.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cache.Get(ctx, "d")
+	assert.Equal(t, context.Canceled, err)
+
+	close(release)
+
+	r := <-patient
+	assert.Nil(t, r.err)
+	assert.Equal(t, secret, r.data)
+}
+
+func TestGet_checksumMismatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	payload := checksummed([]byte("secret data!"))
+	payload.Data = []byte("secret data?")
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{
+			Name:    "bd",
+			Payload: payload,
+		}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", SecretPrefix: "b", DebugLogging: debug}, m)
+	result, err := cache.Get(context.Background(), "d")
+
+	assert.True(t, errors.Is(err, ErrIntegrity))
+	assert.Contains(t, err.Error(), "problem reading secret [projects/a/secrets/bd/versions/latest].")
+	assert.Nil(t, result)
+}
+
 func TestGet_happyPath_sanitizeKey(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -159,7 +314,7 @@ func TestPut_happyPath_noSecretVersions(t *testing.T) {
 		&sliFake{})
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, nil)
 	m.EXPECT().Close().Times(1)
 
@@ -185,7 +340,7 @@ func TestPut_happyPath_oneSV(t *testing.T) {
 		&sliFake{secrets: []*secretmanagerpb.SecretVersion{{Name: activeSV, State: secretmanagerpb.SecretVersion_ENABLED}}})
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, nil)
 	m.EXPECT().DestroySecretVersion(gomock.Eq(&secretmanagerpb.DestroySecretVersionRequest{
 		Name: activeSV,
@@ -221,7 +376,7 @@ func TestPut_happyPath_5_SVs(t *testing.T) {
 		}})
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, nil)
 	m.EXPECT().DestroySecretVersion(gomock.Eq(&secretmanagerpb.DestroySecretVersionRequest{
 		Name: activeSV + "1",
@@ -229,6 +384,10 @@ func TestPut_happyPath_5_SVs(t *testing.T) {
 	m.EXPECT().DestroySecretVersion(gomock.Eq(&secretmanagerpb.DestroySecretVersionRequest{
 		Name: activeSV + "3",
 	})).Return(nil, fmt.Errorf("Fake error"))
+	// Versions disabled by DeleteModeDisableVersions are destroyed too.
+	m.EXPECT().DestroySecretVersion(gomock.Eq(&secretmanagerpb.DestroySecretVersionRequest{
+		Name: activeSV + "4",
+	})).Return(nil, nil)
 	m.EXPECT().DestroySecretVersion(gomock.Eq(&secretmanagerpb.DestroySecretVersionRequest{
 		Name: activeSV + "5",
 	})).Return(nil, nil)
@@ -264,7 +423,7 @@ func TestPut_happyPath_5_SVs_keepSVs(t *testing.T) {
 		}})
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, nil)
 	m.EXPECT().Close().Times(1)
 
@@ -291,6 +450,7 @@ func TestPut_happyPath_NewSecret(t *testing.T) {
 		Parent:   "projects/projId",
 		SecretId: "secrId",
 		Secret: &secretmanagerpb.Secret{
+			Labels: map[string]string{managedLabel: managedLabelValue},
 			Replication: &secretmanagerpb.Replication{
 				Replication: &secretmanagerpb.Replication_Automatic_{
 					Automatic: &secretmanagerpb.Replication_Automatic{},
@@ -300,7 +460,7 @@ func TestPut_happyPath_NewSecret(t *testing.T) {
 	}).Return(nil, nil)
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, nil)
 	m.EXPECT().Close().Times(1)
 
@@ -327,6 +487,7 @@ func TestPut_NewSecret_createError(t *testing.T) {
 		Parent:   "projects/projId",
 		SecretId: "secrId",
 		Secret: &secretmanagerpb.Secret{
+			Labels: map[string]string{managedLabel: managedLabelValue},
 			Replication: &secretmanagerpb.Replication{
 				Replication: &secretmanagerpb.Replication_Automatic_{
 					Automatic: &secretmanagerpb.Replication_Automatic{},
@@ -378,7 +539,7 @@ func TestPut_errorOnSecretVersionCreate(t *testing.T) {
 		&sliFake{})
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, fmt.Errorf("sv create error"))
 	m.EXPECT().Close().Times(1)
 
@@ -404,7 +565,7 @@ func TestPut_happyPath_KeepOldCertificates(t *testing.T) {
 		&sliFake{secrets: []*secretmanagerpb.SecretVersion{{Name: activeSV, State: secretmanagerpb.SecretVersion_ENABLED}}})
 	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secretPath,
-		Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		Payload: checksummed(secret),
 	})).Return(nil, nil)
 	m.EXPECT().Close().Times(1)
 
@@ -488,6 +649,112 @@ func TestDelete_internalError(t *testing.T) {
 		"rpc error: code = Internal desc = not found resp")
 }
 
+func TestGet_location(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("secret data!")
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Eq(
+		&secretmanagerpb.AccessSecretVersionRequest{
+			Name: "projects/a/locations/us-east1/secrets/bd/versions/latest",
+		})).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{
+			Name:    "bd",
+			Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", Location: "us-east1", SecretPrefix: "b", DebugLogging: debug}, m)
+	result, err := cache.Get(context.Background(), "d")
+
+	assert.Nil(t, err)
+	assert.Equal(t, result, secret)
+}
+
+func TestPut_location_NewSecret(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("secret data!")
+	secretPath := "projects/projId/locations/europe-west4/secrets/secrId"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFakeNotFound{})
+	// Regional secrets are created without a replication policy.
+	m.EXPECT().CreateSecret(&secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/projId/locations/europe-west4",
+		SecretId: "secrId",
+		Secret:   &secretmanagerpb.Secret{Labels: map[string]string{managedLabel: managedLabelValue}},
+	}).Return(nil, nil)
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secretPath,
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", Location: "europe-west4", DebugLogging: debug}, m)
+	err := cache.Put(context.Background(), "secrId", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestPut_location_oneSV(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("secret data!")
+	secretPath := "projects/a/locations/us-east1/secrets/d"
+	activeSV := secretPath + "/versions/4"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFake{secrets: []*secretmanagerpb.SecretVersion{{Name: activeSV, State: secretmanagerpb.SecretVersion_ENABLED}}})
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secretPath,
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	m.EXPECT().DestroySecretVersion(gomock.Eq(&secretmanagerpb.DestroySecretVersionRequest{
+		Name: activeSV,
+	})).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", Location: "us-east1", DebugLogging: debug}, m)
+	err := cache.Put(context.Background(), "d", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestDelete_location(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().Close().Times(1)
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/a/locations/us-east1/secrets/Keyyy",
+	})).Return(nil)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "a", Location: "us-east1", DebugLogging: debug}, m)
+	err := cache.Delete(context.Background(), "Keyyy")
+
+	assert.Nil(t, err)
+}
+
+func TestNewSMCache_location(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "a", Location: "us-east1"})
+
+	assert.Equal(t, &api.SecretClientFactoryImpl{Location: "us-east1"}, cache.cf)
+	assert.Equal(t, "secretmanager.us-east1.rep.googleapis.com:443", api.RegionalEndpoint("us-east1"))
+}
+
 func TestSanitize(t *testing.T) {
 	// test filtering out bad chars
 	assert.Equal(t, sanitize("www.example.com"), "www_example_com")
@@ -534,10 +801,16 @@ func (sl *sliFakeError) Next() (*secretmanagerpb.SecretVersion, error) {
 	return nil, status.Error(codes.DeadlineExceeded, "deadline exceeded resp")
 }
 
+// checksummed is the payload Put sends for data, with its CRC32C.
+func checksummed(data []byte) *secretmanagerpb.SecretPayload {
+	crc := int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &crc}
+}
+
 // GRPC mocks
 
-func newCacheWithMockGrpc(config Config, m *apimocks.MockSecretClient) *smCache {
-	c := NewSMCache(config).(*smCache)
+func newCacheWithMockGrpc(config Config, m *apimocks.MockSecretClient) *SMCache {
+	c := NewSMCache(config)
 	c.cf = &mockSecretClientFactoryImpl{mock: m}
 
 	return c
@@ -551,8 +824,8 @@ func (m *mockSecretClientFactoryImpl) NewSecretClient(ctx context.Context) (api.
 	return m.mock, nil
 }
 
-func newCacheWithErrorMockGrpc(config Config, m *apimocks.MockSecretClient) *smCache {
-	c := NewSMCache(config).(*smCache)
+func newCacheWithErrorMockGrpc(config Config, m *apimocks.MockSecretClient) *SMCache {
+	c := NewSMCache(config)
 	c.cf = &mockErrorSecretClientFactoryImpl{mock: m}
 
 	return c
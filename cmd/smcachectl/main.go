@@ -0,0 +1,202 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// smcachectl manages the secrets smcache stores. The Config is read from the
+// SMCACHE_* environment variables, or from the file given with -config.
+//
+// Usage:
+//
+//	smcachectl gc [-config smcache.yaml] [-allow example.com,www.example.com | -allow-file domains.txt]
+//	              [-expired-days 30] [-disable] [-dry-run] [-audit gc.log]
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/jwendel/smcache"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("smcachectl: ")
+
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: smcachectl gc [flags]")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch os.Args[1] {
+	case "gc":
+		if err := gc(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown command [%v], usage: smcachectl gc [flags]", os.Args[1])
+	}
+}
+
+func gc(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	configPath := fs.String("config", "", "smcache config file (.json, .yaml or .yml). If empty, SMCACHE_* environment variables are used")
+	allow := fs.String("allow", "", "comma separated domains that are still wanted")
+	allowFile := fs.String("allow-file", "", "file of domains that are still wanted, one per line")
+	expiredDays := fs.Int("expired-days", 0, "also collect certificates that expired more than this many days ago")
+	disable := fs.Bool("disable", false, "disable all versions of collected secrets, instead of deleting them")
+	dryRun := fs.Bool("dry-run", false, "only report what would be collected")
+	auditPath := fs.String("audit", "", "file to append a JSON record of each collected secret to. Defaults to stdout")
+	labels := fs.String("labels", "", "comma separated key=value labels a secret must have to be looked at")
+	allowEmptyPrefix := fs.Bool("allow-empty-prefix", false, "look at every secret in the project when the config has no secret prefix")
+	includeUnmanaged := fs.Bool("include-unmanaged", false, "also collect secrets under the prefix that smcache did not label as its own")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	domains, err := allowedDomains(*allow, *allowFile)
+	if err != nil {
+		return err
+	}
+
+	selector, err := labelSelector(*labels)
+	if err != nil {
+		return err
+	}
+
+	opts := smcache.GCOptions{
+		ExpiredFor:       time.Duration(*expiredDays) * 24 * time.Hour,
+		Disable:          *disable,
+		DryRun:           *dryRun,
+		AuditLog:         os.Stdout,
+		AllowEmptyPrefix: *allowEmptyPrefix,
+		IncludeUnmanaged: *includeUnmanaged,
+	}
+
+	if selector != nil {
+		opts.ListOptions = &smcache.ListOptions{Labels: selector}
+	}
+
+	if domains != nil {
+		opts.HostPolicy = autocert.HostWhitelist(domains...)
+	}
+
+	if *auditPath != "" {
+		f, err := os.OpenFile(*auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer f.Close()
+
+		opts.AuditLog = f
+	}
+
+	records, err := smcache.NewSMCache(config).GC(ctx, opts)
+	log.Printf("collected %d secrets (dry run: %v)", len(records), *dryRun)
+
+	return err
+}
+
+func loadConfig(path string) (smcache.Config, error) {
+	if path != "" {
+		return smcache.LoadConfig(path)
+	}
+
+	return smcache.ConfigFromEnv()
+}
+
+// labelSelector parses the -labels flag. It returns nil if the flag is empty.
+func labelSelector(labels string) (map[string]string, error) {
+	if labels == "" {
+		return nil, nil
+	}
+
+	m := map[string]string{}
+
+	for _, kv := range strings.Split(labels, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("label [%v] is not a key=value pair", kv)
+		}
+
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return m, nil
+}
+
+// allowedDomains combines the -allow and -allow-file flags. It returns nil if
+// neither was set, so that every domain is allowed.
+func allowedDomains(allow, allowFile string) ([]string, error) {
+	if allow == "" && allowFile == "" {
+		return nil, nil
+	}
+
+	domains := []string{}
+
+	for _, d := range strings.Split(allow, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	if allowFile != "" {
+		f, err := os.Open(allowFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read allowlist: %w", err)
+		}
+		defer f.Close()
+
+		lines, err := readLines(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read allowlist: %w", err)
+		}
+
+		domains = append(domains, lines...)
+	}
+
+	// An empty allowlist would collect every certificate.
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("the allowlist is empty")
+	}
+
+	return domains, nil
+}
+
+// readLines returns the non-empty lines of r, ignoring # comments.
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, s.Err()
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// smemulator is a local stand-in for the Secret Manager API, for development
+// and offline testing. Point smcache at it by setting SMCACHE_EMULATOR_HOST
+// to the address it listens on.
+//
+// Usage:
+//
+//	smemulator [-addr localhost:8086] [-dir ./secrets]
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jwendel/smcache/internal/emulator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8086", "address to listen on")
+	dir := flag.String("dir", "", "directory to store secrets in. If empty, secrets are only kept in memory")
+	flag.Parse()
+
+	srv, err := emulator.New(*dir)
+	if err != nil {
+		log.Fatalf("failed to setup emulator: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen on %v: %v", *addr, err)
+	}
+
+	gs := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(gs, srv)
+
+	// Stop cleanly when docker or a terminal asks us to.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		gs.GracefulStop()
+	}()
+
+	log.Printf("smemulator: listening on %v", lis.Addr())
+
+	if err := gs.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,464 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables read by ConfigFromEnv. Each one sets the Config field
+// of the same name. Booleans accept the values strconv.ParseBool does, durations
+// accept the values time.ParseDuration does, such as "30s", lists are
+// separated by commas, and maps are lists of key=value pairs.
+const (
+	EnvProjectID            = "SMCACHE_PROJECT_ID"
+	EnvLocation             = "SMCACHE_LOCATION"
+	EnvSecretPrefix         = "SMCACHE_SECRET_PREFIX"
+	EnvKeepOldCertificates  = "SMCACHE_KEEP_OLD_CERTIFICATES"
+	EnvKMSKeyName           = "SMCACHE_KMS_KEY_NAME"
+	EnvHTTPTokenTTL         = "SMCACHE_HTTP_TOKEN_TTL"
+	EnvHTTPTokenMemoryCache = "SMCACHE_HTTP_TOKEN_MEMORY_CACHE"
+	EnvMissCacheTTL         = "SMCACHE_MISS_CACHE_TTL"
+	EnvMaxStaleness         = "SMCACHE_MAX_STALENESS"
+	EnvWriteBehind          = "SMCACHE_WRITE_BEHIND"
+	EnvJournalDir           = "SMCACHE_JOURNAL_DIR"
+	EnvDeleteMode           = "SMCACHE_DELETE_MODE"
+	EnvCompress             = "SMCACHE_COMPRESS"
+	EnvEnvelope             = "SMCACHE_ENVELOPE"
+	EnvLabels               = "SMCACHE_LABELS"
+	EnvTopics               = "SMCACHE_TOPICS"
+	EnvWatchInterval        = "SMCACHE_WATCH_INTERVAL"
+	EnvTimeout              = "SMCACHE_TIMEOUT"
+	EnvDebugLogging         = "SMCACHE_DEBUG_LOGGING"
+)
+
+// Environment variables that set the fields of Config.AccountKey. If none of
+// them are set, AccountKey is left nil.
+const (
+	EnvAccountKeyProjectID       = "SMCACHE_ACCOUNT_KEY_PROJECT_ID"
+	EnvAccountKeySecretPrefix    = "SMCACHE_ACCOUNT_KEY_SECRET_PREFIX"
+	EnvAccountKeyKMSKeyName      = "SMCACHE_ACCOUNT_KEY_KMS_KEY_NAME"
+	EnvAccountKeyKeepOldVersions = "SMCACHE_ACCOUNT_KEY_KEEP_OLD_VERSIONS"
+	EnvAccountKeyReadOnly        = "SMCACHE_ACCOUNT_KEY_READ_ONLY"
+)
+
+// Environment variables that set the fields of Config.ReadLimit and
+// Config.WriteLimit. Rates accept the values strconv.ParseFloat does.
+const (
+	EnvReadLimitPerSecond    = "SMCACHE_READ_LIMIT_PER_SECOND"
+	EnvReadLimitBurst        = "SMCACHE_READ_LIMIT_BURST"
+	EnvReadLimitMaxInFlight  = "SMCACHE_READ_LIMIT_MAX_IN_FLIGHT"
+	EnvWriteLimitPerSecond   = "SMCACHE_WRITE_LIMIT_PER_SECOND"
+	EnvWriteLimitBurst       = "SMCACHE_WRITE_LIMIT_BURST"
+	EnvWriteLimitMaxInFlight = "SMCACHE_WRITE_LIMIT_MAX_IN_FLIGHT"
+)
+
+// configFile is the YAML/JSON form of Config read by LoadConfig.
+type configFile struct {
+	ProjectID            string            `json:"projectId" yaml:"projectId"`
+	Location             string            `json:"location" yaml:"location"`
+	SecretPrefix         string            `json:"secretPrefix" yaml:"secretPrefix"`
+	KeepOldCertificates  bool              `json:"keepOldCertificates" yaml:"keepOldCertificates"`
+	KMSKeyName           string            `json:"kmsKeyName" yaml:"kmsKeyName"`
+	AccountKey           *keyPolicyFile    `json:"accountKey" yaml:"accountKey"`
+	HTTPTokenTTL         string            `json:"httpTokenTTL" yaml:"httpTokenTTL"`
+	HTTPTokenMemoryCache bool              `json:"httpTokenMemoryCache" yaml:"httpTokenMemoryCache"`
+	MissCacheTTL         string            `json:"missCacheTTL" yaml:"missCacheTTL"`
+	MaxStaleness         string            `json:"maxStaleness" yaml:"maxStaleness"`
+	WriteBehind          bool              `json:"writeBehind" yaml:"writeBehind"`
+	JournalDir           string            `json:"journalDir" yaml:"journalDir"`
+	DeleteMode           string            `json:"deleteMode" yaml:"deleteMode"`
+	ReadLimit            limitFile         `json:"readLimit" yaml:"readLimit"`
+	WriteLimit           limitFile         `json:"writeLimit" yaml:"writeLimit"`
+	Compress             bool              `json:"compress" yaml:"compress"`
+	Envelope             bool              `json:"envelope" yaml:"envelope"`
+	Labels               map[string]string `json:"labels" yaml:"labels"`
+	Topics               []string          `json:"topics" yaml:"topics"`
+	WatchInterval        string            `json:"watchInterval" yaml:"watchInterval"`
+	Timeout              string            `json:"timeout" yaml:"timeout"`
+	DebugLogging         bool              `json:"debugLogging" yaml:"debugLogging"`
+}
+
+// keyPolicyFile is the YAML/JSON form of KeyPolicy.
+type keyPolicyFile struct {
+	ProjectID       string `json:"projectId" yaml:"projectId"`
+	SecretPrefix    string `json:"secretPrefix" yaml:"secretPrefix"`
+	KMSKeyName      string `json:"kmsKeyName" yaml:"kmsKeyName"`
+	KeepOldVersions bool   `json:"keepOldVersions" yaml:"keepOldVersions"`
+	ReadOnly        bool   `json:"readOnly" yaml:"readOnly"`
+}
+
+// limitFile is the YAML/JSON form of Limit.
+type limitFile struct {
+	PerSecond   float64 `json:"perSecond" yaml:"perSecond"`
+	Burst       int     `json:"burst" yaml:"burst"`
+	MaxInFlight int     `json:"maxInFlight" yaml:"maxInFlight"`
+}
+
+// ConfigFromEnv creates a Config from the SMCACHE_* environment variables listed
+// above. Unset variables leave their field at its default. An error is returned
+// if any variable can't be parsed, or the resulting Config is not valid.
+func ConfigFromEnv() (Config, error) {
+	var problems []string
+
+	c := Config{
+		ProjectID:            os.Getenv(EnvProjectID),
+		Location:             os.Getenv(EnvLocation),
+		SecretPrefix:         os.Getenv(EnvSecretPrefix),
+		KeepOldCertificates:  envBool(EnvKeepOldCertificates, &problems),
+		KMSKeyName:           os.Getenv(EnvKMSKeyName),
+		HTTPTokenTTL:         parseDuration(EnvHTTPTokenTTL, os.Getenv(EnvHTTPTokenTTL), &problems),
+		HTTPTokenMemoryCache: envBool(EnvHTTPTokenMemoryCache, &problems),
+		MissCacheTTL:         parseDuration(EnvMissCacheTTL, os.Getenv(EnvMissCacheTTL), &problems),
+		MaxStaleness:         parseDuration(EnvMaxStaleness, os.Getenv(EnvMaxStaleness), &problems),
+		WriteBehind:          envBool(EnvWriteBehind, &problems),
+		JournalDir:           os.Getenv(EnvJournalDir),
+		DeleteMode:           DeleteMode(os.Getenv(EnvDeleteMode)),
+		ReadLimit: Limit{
+			PerSecond:   envFloat(EnvReadLimitPerSecond, &problems),
+			Burst:       envInt(EnvReadLimitBurst, &problems),
+			MaxInFlight: envInt(EnvReadLimitMaxInFlight, &problems),
+		},
+		WriteLimit: Limit{
+			PerSecond:   envFloat(EnvWriteLimitPerSecond, &problems),
+			Burst:       envInt(EnvWriteLimitBurst, &problems),
+			MaxInFlight: envInt(EnvWriteLimitMaxInFlight, &problems),
+		},
+		Compress:      envBool(EnvCompress, &problems),
+		Envelope:      envBool(EnvEnvelope, &problems),
+		Labels:        envMap(EnvLabels, &problems),
+		Topics:        envList(EnvTopics),
+		WatchInterval: parseDuration(EnvWatchInterval, os.Getenv(EnvWatchInterval), &problems),
+		Timeout:       parseDuration(EnvTimeout, os.Getenv(EnvTimeout), &problems),
+		DebugLogging:  envBool(EnvDebugLogging, &problems),
+	}
+
+	for _, name := range []string{EnvAccountKeyProjectID, EnvAccountKeySecretPrefix, EnvAccountKeyKMSKeyName,
+		EnvAccountKeyKeepOldVersions, EnvAccountKeyReadOnly} {
+		if os.Getenv(name) != "" {
+			c.AccountKey = &KeyPolicy{
+				ProjectID:       os.Getenv(EnvAccountKeyProjectID),
+				SecretPrefix:    os.Getenv(EnvAccountKeySecretPrefix),
+				KMSKeyName:      os.Getenv(EnvAccountKeyKMSKeyName),
+				KeepOldVersions: envBool(EnvAccountKeyKeepOldVersions, &problems),
+				ReadOnly:        envBool(EnvAccountKeyReadOnly, &problems),
+			}
+
+			break
+		}
+	}
+
+	return c, checkConfig(c, problems)
+}
+
+// LoadConfig reads a Config from a JSON (.json) or YAML (.yaml or .yml) file.
+// The keys are the Config field names in lowerCamelCase, for example:
+//
+//	projectId: my-project-1234
+//	location: europe-west4
+//	secretPrefix: test-
+//	keepOldCertificates: false
+//	kmsKeyName: projects/my-project-1234/locations/global/keyRings/r/cryptoKeys/k
+//	accountKey:
+//	  projectId: my-account-project
+//	  readOnly: true
+//	timeout: 30s
+//	debugLogging: true
+//
+// Unknown keys are an error, so typos don't go unnoticed.
+func LoadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var f configFile
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	default:
+		return Config{}, fmt.Errorf("config file [%v] must be .json, .yaml or .yml", path)
+	}
+
+	// An empty file is an empty Config.
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("failed to parse config [%v]: %w", path, err)
+	}
+
+	var problems []string
+
+	c := Config{
+		ProjectID:            f.ProjectID,
+		Location:             f.Location,
+		SecretPrefix:         f.SecretPrefix,
+		KeepOldCertificates:  f.KeepOldCertificates,
+		KMSKeyName:           f.KMSKeyName,
+		HTTPTokenTTL:         parseDuration("httpTokenTTL", f.HTTPTokenTTL, &problems),
+		HTTPTokenMemoryCache: f.HTTPTokenMemoryCache,
+		MissCacheTTL:         parseDuration("missCacheTTL", f.MissCacheTTL, &problems),
+		MaxStaleness:         parseDuration("maxStaleness", f.MaxStaleness, &problems),
+		WriteBehind:          f.WriteBehind,
+		JournalDir:           f.JournalDir,
+		DeleteMode:           DeleteMode(f.DeleteMode),
+		ReadLimit:            Limit(f.ReadLimit),
+		WriteLimit:           Limit(f.WriteLimit),
+		Compress:             f.Compress,
+		Envelope:             f.Envelope,
+		Labels:               f.Labels,
+		Topics:               f.Topics,
+		WatchInterval:        parseDuration("watchInterval", f.WatchInterval, &problems),
+		Timeout:              parseDuration("timeout", f.Timeout, &problems),
+		DebugLogging:         f.DebugLogging,
+	}
+
+	if ak := f.AccountKey; ak != nil {
+		c.AccountKey = &KeyPolicy{
+			ProjectID:       ak.ProjectID,
+			SecretPrefix:    ak.SecretPrefix,
+			KMSKeyName:      ak.KMSKeyName,
+			KeepOldVersions: ak.KeepOldVersions,
+			ReadOnly:        ak.ReadOnly,
+		}
+	}
+
+	return c, checkConfig(c, problems)
+}
+
+var (
+	// Project IDs are 6-30 lowercase letters, digits or hyphens, optionally with a
+	// legacy "domain:" scope. Project numbers are also accepted in resource names.
+	projectIDPattern = regexp.MustCompile(`^(([a-z0-9.-]+:)?[a-z][a-z0-9-]{4,28}[a-z0-9]|[0-9]+)$`)
+	// Locations look like "us-central1" or "northamerica-northeast1".
+	locationPattern = regexp.MustCompile(`^[a-z]+(-[a-z]+)+[0-9]+$`)
+	// Labels keys start with a lowercase letter, and values may be empty.
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+	// Topics are full resource names, like "projects/my-project-1234/topics/certs".
+	topicPattern = regexp.MustCompile(`^projects/[^/]+/topics/[a-zA-Z][a-zA-Z0-9-_.~+%]{2,254}$`)
+)
+
+// maxTopics is the most topics Secret Manager allows on a secret.
+const maxTopics = 10
+
+// Validate checks the Config for mistakes that would stop smcache from working,
+// such as a malformed ProjectID. It does not talk to Secret Manager.
+func (c Config) Validate() error {
+	return checkConfig(c, nil)
+}
+
+// checkConfig combines problems found while parsing a Config with any found by
+// validating it into a single error.
+func checkConfig(c Config, problems []string) error {
+	// An empty ProjectID is detected on first use.
+	if c.ProjectID != "" && !projectIDPattern.MatchString(c.ProjectID) {
+		problems = append(problems, fmt.Sprintf("ProjectID [%v] is not a valid GCP project ID", c.ProjectID))
+	}
+
+	if c.Location != "" && !locationPattern.MatchString(c.Location) {
+		problems = append(problems, fmt.Sprintf("Location [%v] is not a valid GCP location", c.Location))
+	}
+
+	if len(sanitize(c.SecretPrefix)) >= 255 {
+		problems = append(problems, "SecretPrefix leaves no room for a key in the 255 character secret ID")
+	}
+
+	if c.KMSKeyName != "" && c.Location != "" {
+		problems = append(problems, "KMSKeyName is not supported with Location")
+	}
+
+	if ak := c.AccountKey; ak != nil {
+		if ak.ProjectID != "" && !projectIDPattern.MatchString(ak.ProjectID) {
+			problems = append(problems, fmt.Sprintf("AccountKey.ProjectID [%v] is not a valid GCP project ID", ak.ProjectID))
+		}
+
+		if len(sanitize(ak.SecretPrefix)) >= 255 {
+			problems = append(problems, "AccountKey.SecretPrefix leaves no room for a key in the 255 character secret ID")
+		}
+
+		if ak.KMSKeyName != "" && c.Location != "" {
+			problems = append(problems, "AccountKey.KMSKeyName is not supported with Location")
+		}
+	}
+
+	if c.HTTPTokenTTL < 0 {
+		problems = append(problems, "HTTPTokenTTL must not be negative")
+	}
+
+	for k, v := range c.Labels {
+		if !labelKeyPattern.MatchString(k) || !labelValuePattern.MatchString(v) {
+			problems = append(problems, fmt.Sprintf("label [%v=%v] is not a valid GCP label", k, v))
+		}
+
+		if k == managedLabel {
+			problems = append(problems, fmt.Sprintf("label [%v] is set by smcache", k))
+		}
+	}
+
+	for _, t := range c.Topics {
+		if !topicPattern.MatchString(t) {
+			problems = append(problems, fmt.Sprintf("topic [%v] is not a valid Pub/Sub topic name", t))
+		}
+	}
+
+	if len(c.Topics) > maxTopics {
+		problems = append(problems, fmt.Sprintf("a secret can have at most %d Topics", maxTopics))
+	}
+
+	if c.MissCacheTTL < 0 {
+		problems = append(problems, "MissCacheTTL must not be negative")
+	}
+
+	if c.MaxStaleness < 0 {
+		problems = append(problems, "MaxStaleness must not be negative")
+	}
+
+	if c.JournalDir != "" && !c.WriteBehind {
+		problems = append(problems, "JournalDir requires WriteBehind")
+	}
+
+	if !c.DeleteMode.valid() {
+		problems = append(problems, fmt.Sprintf("DeleteMode [%v] must be one of secret, destroy or disable", c.DeleteMode))
+	}
+
+	problems = c.ReadLimit.check("ReadLimit", problems)
+	problems = c.WriteLimit.check("WriteLimit", problems)
+
+	if c.WatchInterval < 0 {
+		problems = append(problems, "WatchInterval must not be negative")
+	}
+
+	if c.Timeout < 0 {
+		problems = append(problems, "Timeout must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid smcache config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// envBool parses the environment variable name as a bool. Unset is false.
+func envBool(name string, problems *[]string) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return false
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s [%v] is not a valid bool", name, v))
+	}
+
+	return b
+}
+
+// envInt parses the environment variable name as an int. Unset is 0.
+func envInt(name string, problems *[]string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s [%v] is not a valid integer", name, v))
+	}
+
+	return i
+}
+
+// envFloat parses the environment variable name as a float64. Unset is 0.
+func envFloat(name string, problems *[]string) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s [%v] is not a valid number", name, v))
+	}
+
+	return f
+}
+
+// envList splits the environment variable name on commas. Unset is nil.
+func envList(name string) []string {
+	var list []string
+
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// envMap parses the environment variable name as comma separated key=value pairs. Unset is nil.
+func envMap(name string, problems *[]string) map[string]string {
+	list := envList(name)
+	if len(list) == 0 {
+		return nil
+	}
+
+	m := map[string]string{}
+
+	for _, kv := range list {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s [%v] is not a key=value pair", name, kv))
+			continue
+		}
+
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return m
+}
+
+// parseDuration parses v as a time.Duration. Empty is zero.
+func parseDuration(name, v string, problems *[]string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s [%v] is not a valid duration", name, v))
+	}
+
+	return d
+}
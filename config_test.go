@@ -0,0 +1,242 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Config{ProjectID: "my-project-1234"}.Validate())
+	assert.Nil(t, Config{ProjectID: "example.com:my-project"}.Validate())
+	assert.Nil(t, Config{ProjectID: "123456789012"}.Validate())
+	assert.Nil(t, Config{ProjectID: "my-project-1234", Location: "us-central1", SecretPrefix: "test-"}.Validate())
+
+	assert.Nil(t, Config{}.Validate())
+	assert.EqualError(t, Config{ProjectID: "My_Project"}.Validate(),
+		"invalid smcache config: ProjectID [My_Project] is not a valid GCP project ID")
+	assert.EqualError(t, Config{ProjectID: "my-project-1234", Location: "global"}.Validate(),
+		"invalid smcache config: Location [global] is not a valid GCP location")
+	assert.EqualError(t, Config{ProjectID: "my-project-1234", SecretPrefix: strings.Repeat("a", 255)}.Validate(),
+		"invalid smcache config: SecretPrefix leaves no room for a key in the 255 character secret ID")
+	assert.EqualError(t, Config{Timeout: -time.Second}.Validate(),
+		"invalid smcache config: Timeout must not be negative")
+	assert.EqualError(t, Config{HTTPTokenTTL: -time.Minute}.Validate(),
+		"invalid smcache config: HTTPTokenTTL must not be negative")
+	assert.EqualError(t, Config{MissCacheTTL: -time.Minute}.Validate(),
+		"invalid smcache config: MissCacheTTL must not be negative")
+	assert.EqualError(t, Config{MaxStaleness: -time.Minute}.Validate(),
+		"invalid smcache config: MaxStaleness must not be negative")
+	assert.EqualError(t, Config{JournalDir: "/var/lib/smcache"}.Validate(),
+		"invalid smcache config: JournalDir requires WriteBehind")
+	assert.Nil(t, Config{DeleteMode: DeleteModeDisableVersions}.Validate())
+	assert.Nil(t, Config{ReadLimit: Limit{PerSecond: 0.5, Burst: 5, MaxInFlight: 10}}.Validate())
+	assert.EqualError(t, Config{ReadLimit: Limit{PerSecond: -1}, WriteLimit: Limit{Burst: 2, MaxInFlight: -1}}.Validate(),
+		"invalid smcache config: ReadLimit.PerSecond must be a number that is not negative; "+
+			"WriteLimit.Burst requires WriteLimit.PerSecond; WriteLimit.MaxInFlight must not be negative")
+	assert.EqualError(t, Config{DeleteMode: "archive"}.Validate(),
+		"invalid smcache config: DeleteMode [archive] must be one of secret, destroy or disable")
+	assert.Nil(t, Config{Labels: map[string]string{"app": "web", "empty": ""}}.Validate())
+	assert.EqualError(t, Config{Labels: map[string]string{managedLabel: "no"}}.Validate(),
+		"invalid smcache config: label [smcache-managed] is set by smcache")
+	assert.EqualError(t, Config{Labels: map[string]string{"App": "web"}}.Validate(),
+		"invalid smcache config: label [App=web] is not a valid GCP label")
+	assert.Nil(t, Config{Topics: []string{"projects/my-project-1234/topics/certs"}}.Validate())
+	assert.EqualError(t, Config{Topics: []string{"certs"}}.Validate(),
+		"invalid smcache config: topic [certs] is not a valid Pub/Sub topic name")
+	assert.EqualError(t, Config{Location: "us-central1", KMSKeyName: "k"}.Validate(),
+		"invalid smcache config: KMSKeyName is not supported with Location")
+	assert.EqualError(t, Config{AccountKey: &KeyPolicy{ProjectID: "p"}}.Validate(),
+		"invalid smcache config: AccountKey.ProjectID [p] is not a valid GCP project ID")
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv(EnvProjectID, "my-project-1234")
+	t.Setenv(EnvLocation, "us-east1")
+	t.Setenv(EnvSecretPrefix, "test-")
+	t.Setenv(EnvKeepOldCertificates, "true")
+	t.Setenv(EnvTimeout, "30s")
+	t.Setenv(EnvDebugLogging, "1")
+
+	c, err := ConfigFromEnv()
+
+	assert.Nil(t, err)
+	assert.Equal(t, Config{
+		ProjectID:           "my-project-1234",
+		Location:            "us-east1",
+		SecretPrefix:        "test-",
+		KeepOldCertificates: true,
+		Timeout:             30 * time.Second,
+		DebugLogging:        true,
+	}, c)
+}
+
+func TestConfigFromEnv_unset(t *testing.T) {
+	for _, name := range []string{EnvProjectID, EnvLocation, EnvSecretPrefix,
+		EnvKeepOldCertificates, EnvKMSKeyName, EnvHTTPTokenTTL, EnvHTTPTokenMemoryCache, EnvMissCacheTTL, EnvMaxStaleness, EnvWriteBehind, EnvJournalDir, EnvDeleteMode, EnvCompress, EnvEnvelope, EnvLabels, EnvTopics, EnvWatchInterval, EnvTimeout, EnvDebugLogging,
+		EnvAccountKeyProjectID, EnvAccountKeySecretPrefix, EnvAccountKeyKMSKeyName,
+		EnvAccountKeyKeepOldVersions, EnvAccountKeyReadOnly,
+		EnvReadLimitPerSecond, EnvReadLimitBurst, EnvReadLimitMaxInFlight,
+		EnvWriteLimitPerSecond, EnvWriteLimitBurst, EnvWriteLimitMaxInFlight} {
+		t.Setenv(name, "")
+	}
+
+	c, err := ConfigFromEnv()
+
+	assert.Nil(t, err)
+	assert.Equal(t, Config{}, c)
+}
+
+func TestConfigFromEnv_accountKey(t *testing.T) {
+	t.Setenv(EnvProjectID, "my-project-1234")
+	t.Setenv(EnvKMSKeyName, "cert-key")
+	t.Setenv(EnvTopics, "projects/a-project/topics/one, projects/a-project/topics/two")
+	t.Setenv(EnvLabels, "app=web, team=infra")
+	t.Setenv(EnvAccountKeyProjectID, "account-project")
+	t.Setenv(EnvAccountKeyReadOnly, "true")
+
+	c, err := ConfigFromEnv()
+
+	assert.Nil(t, err)
+	assert.Equal(t, Config{
+		ProjectID:  "my-project-1234",
+		KMSKeyName: "cert-key",
+		Labels:     map[string]string{"app": "web", "team": "infra"},
+		Topics:     []string{"projects/a-project/topics/one", "projects/a-project/topics/two"},
+		AccountKey: &KeyPolicy{ProjectID: "account-project", ReadOnly: true},
+	}, c)
+}
+
+func TestConfigFromEnv_limits(t *testing.T) {
+	t.Setenv(EnvReadLimitPerSecond, "2.5")
+	t.Setenv(EnvReadLimitMaxInFlight, "8")
+	t.Setenv(EnvWriteLimitPerSecond, "1")
+	t.Setenv(EnvWriteLimitBurst, "3")
+
+	c, err := ConfigFromEnv()
+
+	assert.Nil(t, err)
+	assert.Equal(t, Limit{PerSecond: 2.5, MaxInFlight: 8}, c.ReadLimit)
+	assert.Equal(t, Limit{PerSecond: 1, Burst: 3}, c.WriteLimit)
+
+	t.Setenv(EnvReadLimitBurst, "lots")
+
+	_, err = ConfigFromEnv()
+	assert.EqualError(t, err, "invalid smcache config: SMCACHE_READ_LIMIT_BURST [lots] is not a valid integer")
+}
+
+func TestConfigFromEnv_invalid(t *testing.T) {
+	t.Setenv(EnvProjectID, "My_Project")
+	t.Setenv(EnvKeepOldCertificates, "maybe")
+	t.Setenv(EnvTimeout, "soon")
+	t.Setenv(EnvLabels, "app")
+
+	_, err := ConfigFromEnv()
+
+	assert.EqualError(t, err, "invalid smcache config: "+
+		"SMCACHE_KEEP_OLD_CERTIFICATES [maybe] is not a valid bool; "+
+		"SMCACHE_LABELS [app] is not a key=value pair; "+
+		"SMCACHE_TIMEOUT [soon] is not a valid duration; "+
+		"ProjectID [My_Project] is not a valid GCP project ID")
+}
+
+func TestLoadConfig(t *testing.T) {
+	want := Config{
+		ProjectID:    "my-project-1234",
+		SecretPrefix: "test-",
+		Timeout:      time.Minute,
+		DebugLogging: true,
+	}
+
+	yamlPath := writeConfigFile(t, "smcache.yaml", `
+projectId: my-project-1234
+secretPrefix: test-
+timeout: 1m
+debugLogging: true
+`)
+	c, err := LoadConfig(yamlPath)
+	assert.Nil(t, err)
+	assert.Equal(t, want, c)
+
+	jsonPath := writeConfigFile(t, "smcache.json",
+		`{"projectId": "my-project-1234", "secretPrefix": "test-", "timeout": "1m", "debugLogging": true}`)
+	c, err = LoadConfig(jsonPath)
+	assert.Nil(t, err)
+	assert.Equal(t, want, c)
+
+	c, err = LoadConfig(writeConfigFile(t, "account.yaml", `
+projectId: my-project-1234
+accountKey:
+  projectId: account-project
+  kmsKeyName: account-key
+  keepOldVersions: true
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, Config{
+		ProjectID:  "my-project-1234",
+		AccountKey: &KeyPolicy{ProjectID: "account-project", KMSKeyName: "account-key", KeepOldVersions: true},
+	}, c)
+
+	c, err = LoadConfig(writeConfigFile(t, "limits.yaml", `
+readLimit:
+  perSecond: 2.5
+  maxInFlight: 8
+writeLimit:
+  perSecond: 1
+  burst: 3
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, Config{
+		ReadLimit:  Limit{PerSecond: 2.5, MaxInFlight: 8},
+		WriteLimit: Limit{PerSecond: 1, Burst: 3},
+	}, c)
+
+	c, err = LoadConfig(writeConfigFile(t, "empty.yml", ""))
+	assert.Nil(t, err)
+	assert.Equal(t, Config{}, c)
+}
+
+func TestLoadConfig_errors(t *testing.T) {
+	_, err := LoadConfig(writeConfigFile(t, "smcache.toml", ""))
+	assert.Contains(t, err.Error(), "must be .json, .yaml or .yml")
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Contains(t, err.Error(), "failed to read config")
+
+	_, err = LoadConfig(writeConfigFile(t, "typo.yaml", "projectID: my-project-1234\n"))
+	assert.Contains(t, err.Error(), "failed to parse config")
+
+	_, err = LoadConfig(writeConfigFile(t, "typo.json", `{"projectName": "my-project-1234"}`))
+	assert.Contains(t, err.Error(), "failed to parse config")
+
+	_, err = LoadConfig(writeConfigFile(t, "bad.yaml", "timeout: soon\nlocation: Mars\n"))
+	assert.EqualError(t, err, "invalid smcache config: "+
+		"timeout [soon] is not a valid duration; Location [Mars] is not a valid GCP location")
+}
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.TrimSpace(contents)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
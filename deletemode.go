@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DeleteMode chooses what Delete does to a key's secret, see Config.DeleteMode.
+type DeleteMode string
+
+const (
+	// DeleteModeSecret deletes the secret, with its labels and IAM bindings.
+	DeleteModeSecret DeleteMode = "secret"
+
+	// DeleteModeDestroyVersions destroys every version of the secret, but keeps
+	// the secret with its labels and IAM bindings.
+	DeleteModeDestroyVersions DeleteMode = "destroy"
+
+	// DeleteModeDisableVersions disables every enabled version of the secret.
+	// The delete can be undone by enabling the latest version again.
+	DeleteModeDisableVersions DeleteMode = "disable"
+)
+
+// valid reports whether m is one of the DeleteMode constants, or empty.
+func (m DeleteMode) valid() bool {
+	switch m {
+	case "", DeleteModeSecret, DeleteModeDestroyVersions, DeleteModeDisableVersions:
+		return true
+	default:
+		return false
+	}
+}
+
+// deleteVersions destroys or disables every version of the secret, for
+// DeleteModeDestroyVersions and DeleteModeDisableVersions.
+func (smc *SMCache) deleteVersions(ctx context.Context, conn BackendConn, key, secretName string) error {
+	disable := smc.DeleteMode == DeleteModeDisableVersions
+
+	versions, err := conn.ListVersions(secretName)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("problem listing versions of secret [%v]. %w", secretName, err)
+	}
+
+	var failures []string
+
+	for _, v := range versions {
+		switch {
+		case disable && v.State == VersionEnabled:
+			err = conn.DisableVersion(v.Name)
+		case !disable && v.State != VersionDestroyed:
+			err = smc.destroyVersion(ctx, conn, key, v.Name)
+		default:
+			continue
+		}
+
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", v.Name, err))
+		} else {
+			smc.logf("Delete: %v version %v", smc.DeleteMode, v.Name)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to %v %d versions of secret [%v]: %s",
+			smc.DeleteMode, len(failures), secretName, strings.Join(failures, "; "))
+	}
+
+	return nil
+}
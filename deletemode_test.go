@@ -0,0 +1,141 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func versions() *sliFake {
+	return &sliFake{secrets: []*secretmanagerpb.SecretVersion{
+		{Name: "projects/projId/secrets/example_com/versions/3", State: secretmanagerpb.SecretVersion_ENABLED},
+		{Name: "projects/projId/secrets/example_com/versions/2", State: secretmanagerpb.SecretVersion_DISABLED},
+		{Name: "projects/projId/secrets/example_com/versions/1", State: secretmanagerpb.SecretVersion_DESTROYED},
+	}}
+}
+
+func TestDelete_destroyVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(versions())
+	m.EXPECT().DestroySecretVersion(&secretmanagerpb.DestroySecretVersionRequest{
+		Name: "projects/projId/secrets/example_com/versions/3",
+	}).Return(nil, nil)
+	m.EXPECT().DestroySecretVersion(&secretmanagerpb.DestroySecretVersionRequest{
+		Name: "projects/projId/secrets/example_com/versions/2",
+	}).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DeleteMode: DeleteModeDestroyVersions, DebugLogging: debug}, m)
+
+	assert.Nil(t, cache.Delete(context.Background(), "example.com"))
+}
+
+func TestDelete_disableVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(versions())
+	m.EXPECT().DisableSecretVersion(&secretmanagerpb.DisableSecretVersionRequest{
+		Name: "projects/projId/secrets/example_com/versions/3",
+	}).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DeleteMode: DeleteModeDisableVersions, DebugLogging: debug}, m)
+
+	assert.Nil(t, cache.Delete(context.Background(), "example.com"))
+}
+
+func TestDelete_versionsNotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFakeNotFound{})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DeleteMode: DeleteModeDisableVersions, DebugLogging: debug}, m)
+
+	assert.Nil(t, cache.Delete(context.Background(), "example.com"))
+}
+
+func TestDelete_versionsError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(versions())
+	m.EXPECT().DestroySecretVersion(gomock.Any()).Return(nil, status.Error(codes.PermissionDenied, "denied")).Times(2)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DeleteMode: DeleteModeDestroyVersions, DebugLogging: debug}, m)
+
+	err := cache.Delete(context.Background(), "example.com")
+	assert.EqualError(t, err, "failed to destroy 2 versions of secret [projects/projId/secrets/example_com]: "+
+		"projects/projId/secrets/example_com/versions/3: rpc error: code = PermissionDenied desc = denied; "+
+		"projects/projId/secrets/example_com/versions/2: rpc error: code = PermissionDenied desc = denied")
+}
+
+func TestGet_disabled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil,
+		status.Error(codes.FailedPrecondition, "SecretVersion is in DISABLED state"))
+	m.EXPECT().GetSecretVersion(&secretmanagerpb.GetSecretVersionRequest{
+		Name: "projects/projId/secrets/example_com/versions/latest",
+	}).Return(&secretmanagerpb.SecretVersion{
+		Name:  "projects/projId/secrets/example_com/versions/2",
+		State: secretmanagerpb.SecretVersion_DISABLED,
+	}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+
+	_, err := cache.Get(context.Background(), "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestGet_failedPreconditionEnabled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil,
+		status.Error(codes.FailedPrecondition, "KMS key is disabled"))
+	m.EXPECT().GetSecretVersion(gomock.Any()).Return(&secretmanagerpb.SecretVersion{
+		Name:  "projects/projId/secrets/example_com/versions/2",
+		State: secretmanagerpb.SecretVersion_ENABLED,
+	}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+
+	_, err := cache.Get(context.Background(), "example.com")
+	assert.EqualError(t, err, "rpc error: code = FailedPrecondition desc = KMS key is disabled")
+}
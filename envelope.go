@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// An envelope is a payload stored by Put when Config.Envelope is set. It is laid out as:
+//
+//	magic    5 bytes   "\x00smce"
+//	version  1 byte    envelopeVersion
+//	length   4 bytes   length of the header, big-endian
+//	header   length bytes of JSON, see EnvelopeHeader
+//	body     the rest of the payload: the data passed to Put, encoded as the header says
+//
+// Readers ignore header fields they don't know, so fields can be added without a new
+// version. A new version is only needed if old readers would misread the body.
+var envelopeMagic = []byte("\x00smce")
+
+// envelopeVersion is the only envelope version so far.
+const envelopeVersion = 1
+
+// Content encodings of an envelope's body.
+const (
+	EncodingIdentity = ""
+	EncodingGzip     = "gzip"
+)
+
+// EnvelopeHeader describes the body of an envelope, and where it came from.
+type EnvelopeHeader struct {
+	// Version is the envelope format version.
+	Version int `json:"-"`
+	// ContentEncoding is how the body is compressed, EncodingIdentity or EncodingGzip.
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// Encryption is how the body is encrypted. No schemes are defined yet, and
+	// envelopes with any Encryption set can't be opened.
+	Encryption string `json:"encryption,omitempty"`
+	// Key is the key passed to Put, before it was sanitized.
+	Key string `json:"key"`
+	// Writer is the hostname of the process that called Put.
+	Writer string `json:"writer,omitempty"`
+	// Written is when Put was called.
+	Written time.Time `json:"written"`
+}
+
+// hostname is looked up once, for the Writer of each envelope.
+var hostname = sync.OnceValue(func() string {
+	h, _ := os.Hostname()
+	return h
+})
+
+// seal puts data into an envelope.
+func (smc *SMCache) seal(key string, data []byte) ([]byte, error) {
+	h := EnvelopeHeader{
+		Key:     key,
+		Writer:  hostname(),
+		Written: time.Now().UTC(),
+	}
+
+	body := data
+	if smc.Compress {
+		var err error
+		if body, err = gzipBytes(data); err != nil {
+			return nil, err
+		}
+
+		h.ContentEncoding = EncodingGzip
+	}
+
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write envelope header. %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	buf.WriteByte(envelopeVersion)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(header)))
+	buf.Write(header)
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// OpenEnvelope reads an envelope written by Put, and returns its header and
+// the data that was passed to Put. It is exported for tools that inspect
+// secrets directly; Get opens envelopes itself.
+func OpenEnvelope(payload []byte) (*EnvelopeHeader, []byte, error) {
+	if !bytes.HasPrefix(payload, envelopeMagic) {
+		return nil, nil, errors.New("payload is not an envelope")
+	}
+
+	rest := payload[len(envelopeMagic):]
+	if len(rest) < 5 {
+		return nil, nil, errors.New("envelope is truncated")
+	}
+
+	version := int(rest[0])
+	if version != envelopeVersion {
+		return nil, nil, fmt.Errorf("envelope version %d is not supported", version)
+	}
+
+	n := binary.BigEndian.Uint32(rest[1:5])
+	rest = rest[5:]
+
+	if uint64(n) > uint64(len(rest)) {
+		return nil, nil, errors.New("envelope is truncated")
+	}
+
+	h := &EnvelopeHeader{Version: version}
+	if err := json.Unmarshal(rest[:n], h); err != nil {
+		return nil, nil, fmt.Errorf("failed to read envelope header. %w", err)
+	}
+
+	if h.Encryption != "" {
+		return h, nil, fmt.Errorf("envelope encryption [%v] is not supported", h.Encryption)
+	}
+
+	body := rest[n:]
+
+	switch h.ContentEncoding {
+	case EncodingIdentity:
+		return h, body, nil
+	case EncodingGzip:
+		data, err := gunzipBytes(body)
+		return h, data, err
+	default:
+		return h, nil, fmt.Errorf("envelope content encoding [%v] is not supported", h.ContentEncoding)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// envelopeV1 builds a version 1 envelope by hand, as the format documents it,
+// so these tests fail if seal or OpenEnvelope ever drift from the format.
+func envelopeV1(header, body string) []byte {
+	n := len(header)
+	b := []byte("\x00smce\x01")
+	b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+
+	return append(append(b, header...), body...)
+}
+
+func TestOpenEnvelope_v1(t *testing.T) {
+	payload := envelopeV1(
+		`{"key":"example.com+rsa","writer":"host-1","written":"2020-05-01T10:00:00Z","future":"ignored"}`,
+		"-----BEGIN CERTIFICATE-----")
+
+	h, data, err := OpenEnvelope(payload)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-----BEGIN CERTIFICATE-----"), data)
+	assert.Equal(t, &EnvelopeHeader{
+		Version: 1,
+		Key:     "example.com+rsa",
+		Writer:  "host-1",
+		Written: time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+	}, h)
+
+	// Get's decoding reads envelopes too.
+	data, err = decodePayload(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-----BEGIN CERTIFICATE-----"), data)
+}
+
+func TestOpenEnvelope_v1Gzip(t *testing.T) {
+	compressed, err := gzipBytes([]byte("hello"))
+	assert.Nil(t, err)
+
+	h, data, err := OpenEnvelope(envelopeV1(`{"contentEncoding":"gzip","key":"k","written":"2020-05-01T10:00:00Z"}`,
+		string(compressed)))
+
+	assert.Nil(t, err)
+	assert.Equal(t, EncodingGzip, h.ContentEncoding)
+	assert.Equal(t, []byte("hello"), data)
+}
+
+func TestOpenEnvelope_errors(t *testing.T) {
+	check := func(payload []byte, want string) {
+		t.Helper()
+
+		_, _, err := OpenEnvelope(payload)
+		assert.EqualError(t, err, want)
+	}
+
+	check([]byte("-----BEGIN CERTIFICATE-----"), "payload is not an envelope")
+	check([]byte("\x00smce\x01\x00"), "envelope is truncated")
+	check(envelopeV1(`{"key":"k"}`, "")[:12], "envelope is truncated")
+	check([]byte("\x00smce\x02\x00\x00\x00\x02{}"), "envelope version 2 is not supported")
+	check(envelopeV1(`{"key":"k","encryption":"tink"}`, ""), "envelope encryption [tink] is not supported")
+	check(envelopeV1(`{"key":"k","contentEncoding":"br"}`, ""), "envelope content encoding [br] is not supported")
+}
+
+func TestSeal_roundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		cache := NewSMCache(Config{Envelope: true, Compress: compress})
+
+		payload, err := cache.encodePayload("example.com+rsa", []byte("cert"))
+		assert.Nil(t, err)
+
+		h, data, err := OpenEnvelope(payload)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("cert"), data)
+		assert.Equal(t, "example.com+rsa", h.Key)
+		assert.Equal(t, hostname(), h.Writer)
+		assert.WithinDuration(t, time.Now(), h.Written, time.Minute)
+		assert.Equal(t, compress, h.ContentEncoding == EncodingGzip)
+	}
+}
+
+func TestPut_envelope(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var stored []byte
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{})
+	m.EXPECT().AddSecretVersion(gomock.Any()).DoAndReturn(
+		func(req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+			stored = req.GetPayload().GetData()
+			return nil, nil
+		})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", Envelope: true, DebugLogging: debug}, m)
+	assert.Nil(t, cache.Put(context.Background(), "example.com+rsa", []byte("cert")))
+
+	h, data, err := OpenEnvelope(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com+rsa", h.Key)
+	assert.Equal(t, []byte("cert"), data)
+}
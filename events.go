@@ -0,0 +1,200 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// EventType is the kind of change Secret Manager published an event for.
+type EventType string
+
+// The event types Secret Manager publishes to a secret's topics.
+// See https://cloud.google.com/secret-manager/docs/event-notifications.
+const (
+	EventSecretCreate         EventType = "SECRET_CREATE"
+	EventSecretUpdate         EventType = "SECRET_UPDATE"
+	EventSecretDelete         EventType = "SECRET_DELETE"
+	EventSecretVersionAdd     EventType = "SECRET_VERSION_ADD"
+	EventSecretVersionEnable  EventType = "SECRET_VERSION_ENABLE"
+	EventSecretVersionDisable EventType = "SECRET_VERSION_DISABLE"
+	EventSecretVersionDestroy EventType = "SECRET_VERSION_DESTROY"
+)
+
+// The attributes Secret Manager sets on each event message.
+const (
+	attrEventType = "eventType"
+	attrSecretID  = "secretId"
+	attrVersionID = "versionId"
+)
+
+// Event is a change to a secret smcache stores, as published by Secret Manager.
+type Event struct {
+	// Type is what changed.
+	Type EventType
+	// Key is the autocert key the secret stores, such as "example.com+rsa".
+	// Keys too long to fit in a secret ID are given in their truncated, sanitized form.
+	Key string
+	// SecretName is the resource name of the secret.
+	SecretName string
+	// VersionName is the resource name of the SecretVersion that changed.
+	// It is empty for events about the secret itself.
+	VersionName string
+}
+
+// Message is a Pub/Sub message, as delivered by a MessageSource.
+type Message struct {
+	ID         string
+	Attributes map[string]string
+	Data       []byte
+}
+
+// MessageSource delivers Pub/Sub messages to handler until ctx is done or an
+// error occurs, and is responsible for acknowledging them once handler returns.
+//
+// smcache does not depend on a Pub/Sub client. A *pubsub.Subscription can be
+// used through MessageSourceFunc:
+//
+//	smcache.MessageSourceFunc(func(ctx context.Context, handler func(context.Context, smcache.Message)) error {
+//		return sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+//			handler(ctx, smcache.Message{ID: m.ID, Attributes: m.Attributes, Data: m.Data})
+//			m.Ack()
+//		})
+//	})
+type MessageSource interface {
+	Receive(ctx context.Context, handler func(ctx context.Context, m Message)) error
+}
+
+// MessageSourceFunc is a func that implements MessageSource.
+type MessageSourceFunc func(ctx context.Context, handler func(ctx context.Context, m Message)) error
+
+// Receive calls f.
+func (f MessageSourceFunc) Receive(ctx context.Context, handler func(ctx context.Context, m Message)) error {
+	return f(ctx, handler)
+}
+
+// Subscribe receives Secret Manager event notifications from src, and calls fn
+// for each event about a secret smcache stores. Events for other secrets that
+// share the topic are ignored. The event's key is evicted (see Evict) before fn
+// is called. Subscribe blocks until src.Receive returns.
+//
+// Secrets only publish events to the topics they were created with, see Config.Topics.
+func (smc *SMCache) Subscribe(ctx context.Context, src MessageSource, fn func(ctx context.Context, e Event)) error {
+	if err := smc.requireSecretManager("Subscribe"); err != nil {
+		return err
+	}
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return err
+	}
+
+	err := src.Receive(ctx, func(ctx context.Context, m Message) {
+		e, ok := smc.parseEvent(m)
+		if !ok {
+			smc.logf("Subscribe ignoring message [%v] for secret [%v]", m.ID, m.Attributes[attrSecretID])
+			return
+		}
+
+		smc.logf("Subscribe received %v for [%v]", e.Type, e.SecretName)
+		smc.Evict(e.Key)
+		fn(ctx, e)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to receive events. %w", err)
+	}
+
+	return nil
+}
+
+// parseEvent turns a message into an Event, if it is about a secret smcache stores.
+func (smc *SMCache) parseEvent(m Message) (Event, bool) {
+	e := Event{
+		Type:        EventType(m.Attributes[attrEventType]),
+		SecretName:  m.Attributes[attrSecretID],
+		VersionName: m.Attributes[attrVersionID],
+	}
+
+	if e.Type == "" {
+		return e, false
+	}
+
+	key, ok := smc.keyForSecret(e.SecretName)
+	e.Key = key
+
+	return e, ok
+}
+
+// keyForSecret returns the autocert key stored in the secret with the given
+// resource name, if it is one smcache would use.
+func (smc *SMCache) keyForSecret(name string) (string, bool) {
+	if smc.AccountKey != nil {
+		policy := smc.policyFor(sanitize(accountKey))
+		if id, ok := smc.secretIDIn(name, policy); ok && id == policy.secretPrefix+sanitize(accountKey) {
+			return accountKey, true
+		}
+	}
+
+	id, ok := smc.secretIDIn(name, smc.policyFor(""))
+	if !ok || !strings.HasPrefix(id, smc.SecretPrefix) || len(id) == len(smc.SecretPrefix) {
+		return "", false
+	}
+
+	key, _ := keyFromSecretID(smc.SecretPrefix, strings.TrimPrefix(id, smc.SecretPrefix))
+
+	return key, true
+}
+
+// secretIDIn returns the ID of the secret with the given resource name, if it
+// is in policy's project and the configured Location. Events name the project
+// by number rather than ID, so any project number is accepted.
+func (smc *SMCache) secretIDIn(name string, policy keyPolicy) (string, bool) {
+	parts := strings.Split(name, "/")
+
+	n := 4
+	if smc.Location != "" {
+		n = 6
+	}
+
+	if len(parts) != n || parts[0] != "projects" || parts[n-2] != "secrets" || parts[n-1] == "" {
+		return "", false
+	}
+
+	if smc.Location != "" && (parts[2] != "locations" || parts[3] != smc.Location) {
+		return "", false
+	}
+
+	if parts[1] != policy.projectID && !isProjectNumber(parts[1]) {
+		return "", false
+	}
+
+	return parts[n-1], true
+}
+
+// isProjectNumber reports whether s is a project number rather than a project ID.
+func isProjectNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
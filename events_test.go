@@ -0,0 +1,189 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// fakeSource is an in-memory MessageSource that delivers a fixed list of messages.
+func fakeSource(msgs ...Message) MessageSource {
+	return MessageSourceFunc(func(ctx context.Context, handler func(context.Context, Message)) error {
+		for _, m := range msgs {
+			handler(ctx, m)
+		}
+
+		return nil
+	})
+}
+
+func eventMessage(eventType, secret, version string) Message {
+	return Message{
+		ID: secret + version,
+		Attributes: map[string]string{
+			"eventType":  eventType,
+			"secretId":   secret,
+			"versionId":  version,
+			"dataFormat": "JSON",
+		},
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cache := NewSMCache(Config{
+		ProjectID:    "cert-project",
+		SecretPrefix: "certs-",
+		AccountKey:   &KeyPolicy{ProjectID: "account-project", SecretPrefix: "acme-"},
+		DebugLogging: debug,
+	})
+
+	src := fakeSource(
+		eventMessage("SECRET_VERSION_ADD",
+			"projects/cert-project/secrets/certs-example_com", "projects/cert-project/secrets/certs-example_com/versions/2"),
+		eventMessage("SECRET_VERSION_ADD",
+			"projects/cert-project/secrets/other-example_com", "projects/cert-project/secrets/other-example_com/versions/1"),
+		eventMessage("SECRET_DELETE", "projects/account-project/secrets/acme-acme_account_key", ""),
+		eventMessage("SECRET_DELETE", "projects/other-project/secrets/certs-example_com", ""),
+		eventMessage("", "projects/cert-project/secrets/certs-example_com", ""),
+	)
+
+	var got []Event
+
+	err := cache.Subscribe(context.Background(), src, func(ctx context.Context, e Event) {
+		got = append(got, e)
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		{
+			Type:        EventSecretVersionAdd,
+			Key:         "example.com",
+			SecretName:  "projects/cert-project/secrets/certs-example_com",
+			VersionName: "projects/cert-project/secrets/certs-example_com/versions/2",
+		},
+		{
+			Type:       EventSecretDelete,
+			Key:        "acme_account+key",
+			SecretName: "projects/account-project/secrets/acme-acme_account_key",
+		},
+	}, got)
+}
+
+func TestSubscribe_projectNumber(t *testing.T) {
+	cache := NewSMCache(Config{
+		ProjectID:    "cert-project",
+		Location:     "us-east1",
+		SecretPrefix: "certs-",
+		AccountKey:   &KeyPolicy{SecretPrefix: "acme-"},
+		DebugLogging: debug,
+	})
+
+	src := fakeSource(
+		eventMessage("SECRET_VERSION_ADD", "projects/123456789/locations/us-east1/secrets/certs-example_com",
+			"projects/123456789/locations/us-east1/secrets/certs-example_com/versions/3"),
+		eventMessage("SECRET_DELETE", "projects/123456789/locations/us-east1/secrets/acme-acme_account_key", ""),
+		eventMessage("SECRET_DELETE", "projects/123456789/locations/europe-west1/secrets/certs-example_com", ""),
+		eventMessage("SECRET_DELETE", "projects/123456789/secrets/certs-example_com", ""),
+	)
+
+	var got []Event
+
+	err := cache.Subscribe(context.Background(), src, func(ctx context.Context, e Event) {
+		got = append(got, e)
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		{
+			Type:        EventSecretVersionAdd,
+			Key:         "example.com",
+			SecretName:  "projects/123456789/locations/us-east1/secrets/certs-example_com",
+			VersionName: "projects/123456789/locations/us-east1/secrets/certs-example_com/versions/3",
+		},
+		{
+			Type:       EventSecretDelete,
+			Key:        "acme_account+key",
+			SecretName: "projects/123456789/locations/us-east1/secrets/acme-acme_account_key",
+		},
+	}, got)
+}
+
+func TestSubscribe_evicts(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId", DebugLogging: debug})
+	cache.tokens.put("abc_http-01", []byte("token"), defaultHTTPTokenTTL)
+
+	err := cache.Subscribe(context.Background(),
+		fakeSource(eventMessage("SECRET_DELETE", "projects/projId/secrets/abc_http-01", "")),
+		func(context.Context, Event) {})
+
+	assert.Nil(t, err)
+
+	_, ok := cache.tokens.get("abc_http-01")
+	assert.False(t, ok)
+}
+
+func TestSubscribe_receiveError(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId", DebugLogging: debug})
+	src := MessageSourceFunc(func(context.Context, func(context.Context, Message)) error {
+		return fmt.Errorf("subscription not found")
+	})
+
+	err := cache.Subscribe(context.Background(), src, func(context.Context, Event) {})
+
+	assert.EqualError(t, err, "failed to receive events. subscription not found")
+}
+
+func TestPut_NewSecret_topics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFakeNotFound{})
+	m.EXPECT().CreateSecret(&secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/projId",
+		SecretId: "secrId",
+		Secret: &secretmanagerpb.Secret{
+			Labels: map[string]string{managedLabel: managedLabelValue},
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{
+					Automatic: &secretmanagerpb.Replication_Automatic{},
+				},
+			},
+			Topics: []*secretmanagerpb.Topic{
+				{Name: "projects/projId/topics/certs"},
+				{Name: "projects/projId/topics/audit"},
+			},
+		},
+	}).Return(nil, nil)
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	config := Config{
+		ProjectID:    "projId",
+		Topics:       []string{"projects/projId/topics/certs", "projects/projId/topics/audit"},
+		DebugLogging: debug,
+	}
+	cache := newCacheWithMockGrpc(config, m)
+	err := cache.Put(context.Background(), "secrId", []byte("data"))
+
+	assert.Nil(t, err)
+}
@@ -24,7 +24,8 @@ import (
 
 func main() {
 	m := &autocert.Manager{
-		Cache:      smcache.NewSMCache(smcache.Config{ProjectID: "example-project-1234", SecretPrefix: "test-"}),
+		// ProjectID is detected from the credentials or metadata server this runs with.
+		Cache:      smcache.NewSMCache(smcache.Config{SecretPrefix: "test-"}),
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: autocert.HostWhitelist("example.com", "www.example.com"),
 	}
@@ -24,10 +24,9 @@ import (
 )
 
 func main() {
-	// TODO: you should replace this with your GCP project-id
-	projectID := "example-project-1234"
-
-	smc := smcache.NewSMCache(smcache.Config{ProjectID: projectID, SecretPrefix: "testsite-", DebugLogging: true})
+	// ProjectID is detected from your credentials, the metadata server or
+	// GOOGLE_CLOUD_PROJECT. Set smcache.Config.ProjectID to override it.
+	smc := smcache.NewSMCache(smcache.Config{SecretPrefix: "testsite-", DebugLogging: true})
 	domain := "www.example.com"
 	ctx := context.Background()
 
@@ -0,0 +1,306 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/api/iterator"
+)
+
+// The actions GC takes on a secret.
+const (
+	GCActionDelete  = "delete"
+	GCActionDisable = "disable"
+)
+
+// GCOptions controls which secrets GC collects, and what it does with them.
+type GCOptions struct {
+	// HostPolicy decides which domains are still wanted. Certificates of
+	// domains it returns an error for are collected. autocert.HostWhitelist
+	// turns an allowlist into a HostPolicy.
+	// Optional, defaults to allowing every domain.
+	HostPolicy autocert.HostPolicy
+
+	// ExpiredFor, if set, also collects certificates that expired more than
+	// this long ago, even if their domain is still allowed.
+	// Optional, defaults to not checking expiry.
+	ExpiredFor time.Duration
+
+	// If true, GC disables every version of a collected secret instead of
+	// deleting it, so it can be re-enabled if the collection was a mistake.
+	Disable bool
+
+	// If true, GC only reports what it would collect.
+	DryRun bool
+
+	// AuditLog, if set, has a JSON GCRecord written to it, one per line, for
+	// every secret GC collects (or would collect, with DryRun).
+	AuditLog io.Writer
+
+	// ListOptions narrows down the secrets GC looks at. Optional.
+	ListOptions *ListOptions
+
+	// If true, GC runs when SecretPrefix is empty. Without a prefix every
+	// secret in the project is looked at, so GC otherwise refuses to run
+	// unless ListOptions selects secrets by Labels.
+	AllowEmptyPrefix bool
+
+	// If true, secrets under a non-empty SecretPrefix are collected even
+	// without the "smcache-managed" label, such as those created by older
+	// versions of smcache. Without a prefix, unlabelled secrets are never collected.
+	IncludeUnmanaged bool
+}
+
+// GCRecord describes a secret that GC collected.
+type GCRecord struct {
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key"`
+	SecretName string    `json:"secretName"`
+	Reason     string    `json:"reason"`
+	Action     string    `json:"action"`
+	DryRun     bool      `json:"dryRun"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// GC finds the certificates under SecretPrefix whose domain HostPolicy no longer
+// allows, or which expired more than ExpiredFor ago, and deletes or disables them.
+// Only secrets labelled as created by smcache (see Entry.Managed) are collected,
+// unless IncludeUnmanaged is set. The ACME account key, http-01 tokens (see
+// SweepHTTPTokens) and keys not listed exactly are never collected.
+//
+// Each secret is collected the way Delete removes one: Hooks are called around
+// it with OpDelete, and the key is evicted from memory (see Evict).
+//
+// A record of each secret collected is returned. GC carries on past secrets it
+// could not collect, and returns an error describing them at the end.
+func (smc *SMCache) GC(ctx context.Context, opts GCOptions) ([]GCRecord, error) {
+	if opts.HostPolicy == nil && opts.ExpiredFor <= 0 {
+		return nil, errors.New("GC needs a HostPolicy or ExpiredFor to decide what to collect")
+	}
+
+	if smc.SecretPrefix == "" && !opts.AllowEmptyPrefix && (opts.ListOptions == nil || len(opts.ListOptions.Labels) == 0) {
+		return nil, errors.New("GC refuses to look at every secret in the project while SecretPrefix is empty, " +
+			"set ListOptions.Labels or AllowEmptyPrefix")
+	}
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return nil, err
+	}
+
+	conn, err := smc.backend().Open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer conn.Close()
+
+	action := GCActionDelete
+	if opts.Disable {
+		action = GCActionDisable
+	}
+
+	var (
+		records  []GCRecord
+		failures []string
+	)
+
+	it := smc.Entries(ctx, opts.ListOptions)
+	defer it.Stop()
+
+	for {
+		e, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return records, err
+		}
+
+		if !e.Exact || e.Key == accountKey || strings.HasSuffix(e.Key, httpTokenSuffix) {
+			continue
+		}
+
+		if !e.Managed && !(opts.IncludeUnmanaged && smc.SecretPrefix != "") {
+			smc.logf("GC skipping [%v], which smcache did not label as its own", e.SecretName)
+			continue
+		}
+
+		reason, err := smc.gcReason(ctx, conn, e, opts)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", e.SecretName, err))
+			continue
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		r := GCRecord{
+			Time:       time.Now(),
+			Key:        e.Key,
+			SecretName: e.SecretName,
+			Reason:     reason,
+			Action:     action,
+			DryRun:     opts.DryRun,
+		}
+
+		if !opts.DryRun {
+			if err := smc.gcCollect(ctx, conn, e, opts.Disable); err != nil {
+				r.Error = err.Error()
+				failures = append(failures, fmt.Sprintf("%v: %v", e.SecretName, err))
+			}
+		}
+
+		smc.logf("GC %v [%v] (dry run: %v): %v", action, e.SecretName, opts.DryRun, reason)
+		records = append(records, r)
+
+		if opts.AuditLog != nil {
+			if err := json.NewEncoder(opts.AuditLog).Encode(r); err != nil {
+				return records, fmt.Errorf("failed to write audit log. %w", err)
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return records, fmt.Errorf("failed to collect %d secrets: %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	return records, nil
+}
+
+// gcReason returns why the entry should be collected, or "" if it should be kept.
+func (smc *SMCache) gcReason(ctx context.Context, conn BackendConn, e Entry, opts GCOptions) (string, error) {
+	domain := keyDomain(e.Key)
+
+	if opts.HostPolicy != nil {
+		if err := opts.HostPolicy(ctx, domain); err != nil {
+			return fmt.Sprintf("domain [%v] is not allowed: %v", domain, err), nil
+		}
+	}
+
+	if opts.ExpiredFor <= 0 {
+		return "", nil
+	}
+
+	stored, _, err := conn.AccessLatest(e.SecretName)
+	if errors.Is(err, ErrNotFound) {
+		// Nothing left to read, such as a secret that was already disabled.
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	data, err := decodePayload(stored)
+	if err != nil {
+		return "", err
+	}
+
+	notAfter, err := certNotAfter(data)
+	if err != nil {
+		return "", err
+	}
+
+	if time.Since(notAfter) > opts.ExpiredFor {
+		return fmt.Sprintf("certificate expired at %v", notAfter.Format(time.RFC3339)), nil
+	}
+
+	return "", nil
+}
+
+// gcCollect collects the entry's secret the way Delete removes one: between the
+// Delete hooks, dropping any queued Put of the key, and evicting what smcache
+// holds in memory for it, so a running cache stops serving it.
+func (smc *SMCache) gcCollect(ctx context.Context, conn BackendConn, e Entry, disable bool) error {
+	info, err := smc.before(ctx, OpDelete, e.Key, "")
+	if err != nil {
+		return err
+	}
+
+	release, err := smc.dequeue(sanitize(e.Key))
+	if err == nil {
+		err = collect(conn, e.SecretName, disable)
+		smc.Evict(e.Key)
+		release()
+	}
+
+	smc.after(ctx, info, err)
+
+	return err
+}
+
+// collect deletes the secret, or disables all of its enabled versions.
+func collect(conn BackendConn, secretName string, disable bool) error {
+	if !disable {
+		err := conn.DeleteSecret(secretName)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	versions, err := conn.ListVersions(secretName)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if v.State != VersionEnabled {
+			continue
+		}
+
+		if err := conn.DisableVersion(v.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// certNotAfter returns when the leaf certificate stored by autocert expires.
+// autocert stores the private key followed by the certificate chain, all PEM encoded.
+func certNotAfter(data []byte) (time.Time, error) {
+	for {
+		var b *pem.Block
+
+		b, data = pem.Decode(data)
+		if b == nil {
+			return time.Time{}, errors.New("no certificate found")
+		}
+
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse certificate. %w", err)
+		}
+
+		return cert.NotAfter, nil
+	}
+}
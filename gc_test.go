@@ -0,0 +1,286 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// gcSecrets are the secrets listed in each GC test.
+func gcSecrets() *secretsFake {
+	return &secretsFake{secrets: []*secretmanagerpb.Secret{
+		managedSecret("projects/projId/secrets/kept_example"),
+		managedSecret("projects/projId/secrets/gone_example"),
+		managedSecret("projects/projId/secrets/gone_example_rsa"),
+		managedSecret("projects/projId/secrets/acme_account_key"),
+		managedSecret("projects/projId/secrets/abc_http-01"),
+	}}
+}
+
+func TestGC_hostPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(gcSecrets())
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/projId/secrets/gone_example",
+	})).Return(nil)
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/projId/secrets/gone_example_rsa",
+	})).Return(nil)
+	m.EXPECT().Close().Times(2)
+
+	var audit bytes.Buffer
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	records, err := cache.GC(context.Background(), GCOptions{
+		HostPolicy:       autocert.HostWhitelist("kept.example"),
+		AllowEmptyPrefix: true,
+		AuditLog:         &audit,
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "gone.example", records[0].Key)
+	assert.Equal(t, "gone.example+rsa", records[1].Key)
+	assert.Equal(t, GCActionDelete, records[1].Action)
+	assert.Contains(t, records[1].Reason, "domain [gone.example] is not allowed")
+
+	var logged GCRecord
+	assert.Nil(t, json.NewDecoder(&audit).Decode(&logged))
+	assert.Equal(t, "projects/projId/secrets/gone_example", logged.SecretName)
+	assert.False(t, logged.DryRun)
+}
+
+func TestGC_dryRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(gcSecrets())
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	records, err := cache.GC(context.Background(), GCOptions{
+		HostPolicy:       autocert.HostWhitelist("kept.example"),
+		AllowEmptyPrefix: true,
+		Disable:          true,
+		DryRun:           true,
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	assert.True(t, records[0].DryRun)
+	assert.Equal(t, GCActionDisable, records[0].Action)
+}
+
+func TestGC_disable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		managedSecret("projects/projId/secrets/gone_example"),
+	}})
+	m.EXPECT().ListSecretVersions(gomock.Eq(&secretmanagerpb.ListSecretVersionsRequest{
+		Parent:   "projects/projId/secrets/gone_example",
+		PageSize: listPageSize,
+	})).Return(&sliFake{secrets: []*secretmanagerpb.SecretVersion{
+		{Name: "projects/projId/secrets/gone_example/versions/2", State: secretmanagerpb.SecretVersion_ENABLED},
+		{Name: "projects/projId/secrets/gone_example/versions/1", State: secretmanagerpb.SecretVersion_DESTROYED},
+	}})
+	m.EXPECT().DisableSecretVersion(gomock.Eq(&secretmanagerpb.DisableSecretVersionRequest{
+		Name: "projects/projId/secrets/gone_example/versions/2",
+	})).Return(nil, nil)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	records, err := cache.GC(context.Background(), GCOptions{
+		HostPolicy:       autocert.HostWhitelist("kept.example"),
+		AllowEmptyPrefix: true,
+		Disable:          true,
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestGC_expired(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		managedSecret("projects/projId/secrets/old_example"),
+		managedSecret("projects/projId/secrets/new_example"),
+	}})
+	m.EXPECT().AccessSecretVersion(gomock.Eq(&secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/projId/secrets/old_example/versions/latest",
+	})).Return(&secretmanagerpb.AccessSecretVersionResponse{
+		Payload: &secretmanagerpb.SecretPayload{Data: testCertPEM(t, time.Now().Add(-40*24*time.Hour))},
+	}, nil)
+	m.EXPECT().AccessSecretVersion(gomock.Eq(&secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/projId/secrets/new_example/versions/latest",
+	})).Return(&secretmanagerpb.AccessSecretVersionResponse{
+		Payload: &secretmanagerpb.SecretPayload{Data: testCertPEM(t, time.Now().Add(-time.Hour))},
+	}, nil)
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/projId/secrets/old_example",
+	})).Return(nil)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	records, err := cache.GC(context.Background(), GCOptions{ExpiredFor: 30 * 24 * time.Hour, AllowEmptyPrefix: true})
+
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "old.example", records[0].Key)
+	assert.Contains(t, records[0].Reason, "certificate expired at")
+}
+
+func TestGC_emptyPrefix(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId"})
+	_, err := cache.GC(context.Background(), GCOptions{HostPolicy: autocert.HostWhitelist("kept.example")})
+
+	assert.EqualError(t, err, "GC refuses to look at every secret in the project while SecretPrefix is empty, "+
+		"set ListOptions.Labels or AllowEmptyPrefix")
+}
+
+func TestGC_unmanaged(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	listed := func() *secretsFake {
+		return &secretsFake{secrets: []*secretmanagerpb.Secret{
+			{Name: "projects/projId/secrets/db_password"},
+			{Name: "projects/projId/secrets/certs-gone_example"},
+			managedSecret("projects/projId/secrets/certs-old_example"),
+		}}
+	}
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	for i := 0; i < 3; i++ {
+		m.EXPECT().ListSecrets(gomock.Any()).Return(listed())
+	}
+	m.EXPECT().Close().Times(6)
+
+	policy := autocert.HostWhitelist("kept.example")
+
+	// Without a prefix, only labelled secrets are collected.
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	records, err := cache.GC(context.Background(), GCOptions{
+		HostPolicy:  policy,
+		DryRun:      true,
+		ListOptions: &ListOptions{Labels: map[string]string{"app": "web"}},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "certs-old.example", records[0].Key)
+
+	// With a prefix, unlabelled secrets under it are collected only if asked.
+	cache = newCacheWithMockGrpc(Config{ProjectID: "projId", SecretPrefix: "certs-", DebugLogging: debug}, m)
+	records, err = cache.GC(context.Background(), GCOptions{HostPolicy: policy, DryRun: true})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "old.example", records[0].Key)
+
+	records, err = cache.GC(context.Background(), GCOptions{HostPolicy: policy, DryRun: true, IncludeUnmanaged: true})
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestGC_evictsAndHooks(t *testing.T) {
+	var ops []string
+
+	cache := NewSMCache(Config{
+		ProjectID:    "projId",
+		SecretPrefix: "certs-",
+		Backend:      NewMemoryBackend(),
+		MaxStaleness: time.Hour,
+		Hooks: Hooks{After: func(ctx context.Context, info HookInfo) {
+			ops = append(ops, fmt.Sprintf("%v %v", info.Op, info.Key))
+		}},
+		DebugLogging: debug,
+	})
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "gone.example", []byte("cert")))
+	_, err := cache.Get(ctx, "gone.example")
+	assert.Nil(t, err)
+	assert.Contains(t, cache.stale.entries, "gone_example")
+
+	ops = nil
+	records, err := cache.GC(ctx, GCOptions{HostPolicy: autocert.HostWhitelist("kept.example")})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, []string{"delete gone.example"}, ops)
+	assert.NotContains(t, cache.stale.entries, "gone_example")
+}
+
+func TestGC_needsPolicy(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId"})
+	_, err := cache.GC(context.Background(), GCOptions{DryRun: true})
+
+	assert.EqualError(t, err, "GC needs a HostPolicy or ExpiredFor to decide what to collect")
+}
+
+// testCertPEM returns a private key and self-signed certificate that expires
+// at notAfter, PEM encoded the way autocert stores them.
+func testCertPEM(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return buf.Bytes()
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrVetoed is returned by an operation that Hooks.Before rejected. The error
+// also wraps the one Before returned.
+var ErrVetoed = errors.New("smcache: operation vetoed by hook")
+
+// Op names an operation passed to Hooks.
+type Op string
+
+const (
+	OpGet            Op = "get"
+	OpPut            Op = "put"
+	OpDelete         Op = "delete"
+	OpDestroyVersion Op = "destroy version"
+)
+
+// Hooks are called around Get, Put and Delete (including each secret GC
+// collects), and around destroying each old SecretVersion (by Put, or by Delete
+// with DeleteModeDestroyVersions). They may be called concurrently, and by the
+// WriteBehind worker, and hold up the operation until they return.
+type Hooks struct {
+	// Before is called before the operation. If it returns an error, the
+	// operation is not done and returns an error wrapping ErrVetoed and it.
+	// A vetoed destroy leaves that version in place.
+	Before func(ctx context.Context, info HookInfo) error
+
+	// After is called once the operation is done (or vetoed), with its
+	// Duration and Err set.
+	After func(ctx context.Context, info HookInfo)
+}
+
+// HookInfo describes an operation passed to Hooks.
+type HookInfo struct {
+	Op Op
+
+	// Key is the autocert key, as passed to Get, Put or Delete.
+	Key string
+
+	// SecretName is the full resource name of the key's secret.
+	SecretName string
+
+	// VersionName is the full resource name of the SecretVersion: the one
+	// destroyed, or, in After only, the one Get read or Put added. It's empty
+	// when Get is answered from memory, or Put is queued by WriteBehind.
+	VersionName string
+
+	// Duration and Err are only set in After.
+	Duration time.Duration
+	Err      error
+
+	start time.Time
+}
+
+func (h Hooks) empty() bool {
+	return h.Before == nil && h.After == nil
+}
+
+// before starts the HookInfo of an operation, and runs Hooks.Before. If the
+// operation is vetoed, it runs Hooks.After too.
+func (smc *SMCache) before(ctx context.Context, op Op, key, versionName string) (HookInfo, error) {
+	info := HookInfo{Op: op, Key: key, VersionName: versionName, start: time.Now()}
+
+	if smc.Hooks.empty() {
+		return info, nil
+	}
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return info, err
+	}
+
+	info.SecretName = smc.secretName(sanitize(key))
+
+	if smc.Hooks.Before != nil {
+		if err := smc.Hooks.Before(ctx, info); err != nil {
+			err = fmt.Errorf("%w: cannot %v [%v]. %w", ErrVetoed, op, key, err)
+			smc.after(ctx, info, err)
+
+			return info, err
+		}
+	}
+
+	return info, nil
+}
+
+// after runs Hooks.After for an operation that returned err, and records err
+// in the recent errors.
+func (smc *SMCache) after(ctx context.Context, info HookInfo, err error) {
+	smc.errs.add(info.Op, info.Key, err)
+
+	if smc.Hooks.After == nil {
+		return
+	}
+
+	info.Duration = time.Since(info.start)
+	info.Err = err
+	smc.Hooks.After(ctx, info)
+}
+
+// destroyVersion destroys the named SecretVersion of key, running Hooks around it.
+func (smc *SMCache) destroyVersion(ctx context.Context, conn BackendConn, key, versionName string) error {
+	info, err := smc.before(ctx, OpDestroyVersion, key, versionName)
+	if err != nil {
+		return err
+	}
+
+	err = conn.DestroyVersion(versionName)
+	smc.after(ctx, info, err)
+
+	return err
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hookLog records the HookInfo passed to Hooks, dropping the timings.
+type hookLog struct {
+	mu    sync.Mutex
+	calls []string
+	infos []HookInfo
+}
+
+func (l *hookLog) hooks(veto Op) Hooks {
+	return Hooks{
+		Before: func(ctx context.Context, info HookInfo) error {
+			l.record("before", info)
+
+			if info.Op == veto {
+				return errors.New("not today")
+			}
+
+			return nil
+		},
+		After: func(ctx context.Context, info HookInfo) {
+			info.Duration = 0
+			l.record("after", info)
+		},
+	}
+}
+
+func (l *hookLog) record(when string, info HookInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info.start = time.Time{}
+	l.calls = append(l.calls, when+" "+string(info.Op))
+	l.infos = append(l.infos, info)
+}
+
+func TestHooks_put(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{secrets: []*secretmanagerpb.SecretVersion{
+		{Name: "projects/projId/secrets/example_com/versions/1", State: secretmanagerpb.SecretVersion_ENABLED},
+	}})
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(
+		&secretmanagerpb.SecretVersion{Name: "projects/projId/secrets/example_com/versions/2"}, nil)
+	m.EXPECT().DestroySecretVersion(gomock.Any()).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	var log hookLog
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", Hooks: log.hooks(""), DebugLogging: debug}, m)
+	assert.Nil(t, cache.Put(context.Background(), "example.com", []byte("cert")))
+
+	assert.Equal(t, []string{"before put", "before destroy version", "after destroy version", "after put"}, log.calls)
+	assert.Equal(t, HookInfo{
+		Op:          OpDestroyVersion,
+		Key:         "example.com",
+		SecretName:  "projects/projId/secrets/example_com",
+		VersionName: "projects/projId/secrets/example_com/versions/1",
+	}, log.infos[2])
+	assert.Equal(t, HookInfo{
+		Op:          OpPut,
+		Key:         "example.com",
+		SecretName:  "projects/projId/secrets/example_com",
+		VersionName: "projects/projId/secrets/example_com/versions/2",
+	}, log.infos[3])
+}
+
+func TestHooks_get(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	gomock.InOrder(
+		m.EXPECT().AccessSecretVersion(gomock.Any()).Return(&secretmanagerpb.AccessSecretVersionResponse{
+			Name:    "projects/projId/secrets/example_com/versions/7",
+			Payload: checksummed([]byte("cert")),
+		}, nil),
+		m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, status.Error(codes.NotFound, "not found")),
+	)
+	m.EXPECT().Close().Times(2)
+
+	var log hookLog
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", Hooks: log.hooks(""), DebugLogging: debug}, m)
+
+	_, err := cache.Get(context.Background(), "example.com")
+	assert.Nil(t, err)
+
+	_, err = cache.Get(context.Background(), "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+
+	assert.Equal(t, []HookInfo{
+		{Op: OpGet, Key: "example.com", SecretName: "projects/projId/secrets/example_com"},
+		{
+			Op:          OpGet,
+			Key:         "example.com",
+			SecretName:  "projects/projId/secrets/example_com",
+			VersionName: "projects/projId/secrets/example_com/versions/7",
+		},
+		{Op: OpGet, Key: "example.com", SecretName: "projects/projId/secrets/example_com"},
+		{Op: OpGet, Key: "example.com", SecretName: "projects/projId/secrets/example_com", Err: autocert.ErrCacheMiss},
+	}, log.infos)
+}
+
+func TestHooks_veto(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No calls to Secret Manager are expected.
+	m := apimocks.NewMockSecretClient(ctrl)
+
+	var log hookLog
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", Hooks: log.hooks(OpDelete), DebugLogging: debug}, m)
+
+	err := cache.Delete(context.Background(), "example.com")
+	assert.True(t, errors.Is(err, ErrVetoed))
+	assert.EqualError(t, err, "smcache: operation vetoed by hook: cannot delete [example.com]. not today")
+
+	assert.Equal(t, []string{"before delete", "after delete"}, log.calls)
+	assert.Equal(t, err, log.infos[1].Err)
+}
+
+func TestHooks_vetoDestroy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{secrets: []*secretmanagerpb.SecretVersion{
+		{Name: "projects/projId/secrets/example_com/versions/1", State: secretmanagerpb.SecretVersion_ENABLED},
+	}})
+	m.EXPECT().Close().Times(1)
+
+	var log hookLog
+
+	cache := newCacheWithMockGrpc(Config{
+		ProjectID: "projId", DeleteMode: DeleteModeDestroyVersions, Hooks: log.hooks(OpDestroyVersion), DebugLogging: debug,
+	}, m)
+
+	err := cache.Delete(context.Background(), "example.com")
+	assert.EqualError(t, err, "failed to destroy 1 versions of secret [projects/projId/secrets/example_com]: "+
+		"projects/projId/secrets/example_com/versions/1: smcache: operation vetoed by hook: "+
+		"cannot destroy version [example.com]. not today")
+	assert.Equal(t, []string{"before delete", "before destroy version", "after destroy version", "after delete"}, log.calls)
+}
@@ -22,6 +22,7 @@ import (
 	context "context"
 	reflect "reflect"
 
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
 	gomock "github.com/golang/mock/gomock"
 	"github.com/jwendel/smcache/internal/api"
 	secretmanager "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
@@ -103,6 +104,21 @@ func (mr *MockSecretClientMockRecorder) AccessSecretVersion(req interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AccessSecretVersion", reflect.TypeOf((*MockSecretClient)(nil).AccessSecretVersion), req)
 }
 
+// GetSecretVersion mocks base method
+func (m *MockSecretClient) GetSecretVersion(req *secretmanager.GetSecretVersionRequest) (*secretmanager.SecretVersion, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSecretVersion", req)
+	ret0, _ := ret[0].(*secretmanager.SecretVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSecretVersion indicates an expected call of GetSecretVersion
+func (mr *MockSecretClientMockRecorder) GetSecretVersion(req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSecretVersion", reflect.TypeOf((*MockSecretClient)(nil).GetSecretVersion), req)
+}
+
 // ListSecretVersions mocks base method
 func (m *MockSecretClient) ListSecretVersions(req *secretmanager.ListSecretVersionsRequest) api.SecretListIterator {
 	m.ctrl.T.Helper()
@@ -117,6 +133,20 @@ func (mr *MockSecretClientMockRecorder) ListSecretVersions(req interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListSecretVersions", reflect.TypeOf((*MockSecretClient)(nil).ListSecretVersions), req)
 }
 
+// ListSecrets mocks base method
+func (m *MockSecretClient) ListSecrets(req *secretmanager.ListSecretsRequest) api.SecretIterator {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListSecrets", req)
+	ret0, _ := ret[0].(api.SecretIterator)
+	return ret0
+}
+
+// ListSecrets indicates an expected call of ListSecrets
+func (mr *MockSecretClientMockRecorder) ListSecrets(req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListSecrets", reflect.TypeOf((*MockSecretClient)(nil).ListSecrets), req)
+}
+
 // DestroySecretVersion mocks base method
 func (m *MockSecretClient) DestroySecretVersion(req *secretmanager.DestroySecretVersionRequest) (*secretmanager.SecretVersion, error) {
 	m.ctrl.T.Helper()
@@ -132,6 +162,21 @@ func (mr *MockSecretClientMockRecorder) DestroySecretVersion(req interface{}) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DestroySecretVersion", reflect.TypeOf((*MockSecretClient)(nil).DestroySecretVersion), req)
 }
 
+// DisableSecretVersion mocks base method
+func (m *MockSecretClient) DisableSecretVersion(req *secretmanager.DisableSecretVersionRequest) (*secretmanager.SecretVersion, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisableSecretVersion", req)
+	ret0, _ := ret[0].(*secretmanager.SecretVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DisableSecretVersion indicates an expected call of DisableSecretVersion
+func (mr *MockSecretClientMockRecorder) DisableSecretVersion(req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisableSecretVersion", reflect.TypeOf((*MockSecretClient)(nil).DisableSecretVersion), req)
+}
+
 // CreateSecret mocks base method
 func (m *MockSecretClient) CreateSecret(req *secretmanager.CreateSecretRequest) (*secretmanager.Secret, error) {
 	m.ctrl.T.Helper()
@@ -176,6 +221,21 @@ func (mr *MockSecretClientMockRecorder) DeleteSecret(req interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSecret", reflect.TypeOf((*MockSecretClient)(nil).DeleteSecret), req)
 }
 
+// TestIamPermissions mocks base method
+func (m *MockSecretClient) TestIamPermissions(req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TestIamPermissions", req)
+	ret0, _ := ret[0].(*iampb.TestIamPermissionsResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TestIamPermissions indicates an expected call of TestIamPermissions
+func (mr *MockSecretClientMockRecorder) TestIamPermissions(req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TestIamPermissions", reflect.TypeOf((*MockSecretClient)(nil).TestIamPermissions), req)
+}
+
 // Close mocks base method
 func (m *MockSecretClient) Close() error {
 	m.ctrl.T.Helper()
@@ -227,3 +287,41 @@ func (mr *MockSecretListIteratorMockRecorder) Next() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockSecretListIterator)(nil).Next))
 }
+
+// MockSecretIterator is a mock of SecretIterator interface
+type MockSecretIterator struct {
+	ctrl     *gomock.Controller
+	recorder *MockSecretIteratorMockRecorder
+}
+
+// MockSecretIteratorMockRecorder is the mock recorder for MockSecretIterator
+type MockSecretIteratorMockRecorder struct {
+	mock *MockSecretIterator
+}
+
+// NewMockSecretIterator creates a new mock instance
+func NewMockSecretIterator(ctrl *gomock.Controller) *MockSecretIterator {
+	mock := &MockSecretIterator{ctrl: ctrl}
+	mock.recorder = &MockSecretIteratorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSecretIterator) EXPECT() *MockSecretIteratorMockRecorder {
+	return m.recorder
+}
+
+// Next mocks base method
+func (m *MockSecretIterator) Next() (*secretmanager.Secret, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Next")
+	ret0, _ := ret[0].(*secretmanager.Secret)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Next indicates an expected call of Next
+func (mr *MockSecretIteratorMockRecorder) Next() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockSecretIterator)(nil).Next))
+}
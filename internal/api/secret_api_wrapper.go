@@ -17,11 +17,21 @@ package api
 import (
 	"context"
 	"fmt"
+	"os"
 
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
 	sm "cloud.google.com/go/secretmanager/apiv1"
+	"google.golang.org/api/option"
 	smpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
+// EmulatorHostEnv is the environment variable that points smcache at a local
+// Secret Manager emulator (such as cmd/smemulator) instead of the real API.
+// Its value is a host:port, which is connected to without TLS or credentials.
+const EmulatorHostEnv = "SMCACHE_EMULATOR_HOST"
+
 // ClientFactory is used to create SecretClient, which is the GRPC Secret Client
 // in normal use, but can be mocked for tests.
 type ClientFactory interface {
@@ -32,11 +42,15 @@ type ClientFactory interface {
 // It is entirely for the purpose of being able to mock these for testing.
 type SecretClient interface {
 	AccessSecretVersion(req *smpb.AccessSecretVersionRequest) (*smpb.AccessSecretVersionResponse, error)
+	GetSecretVersion(req *smpb.GetSecretVersionRequest) (*smpb.SecretVersion, error)
 	ListSecretVersions(req *smpb.ListSecretVersionsRequest) SecretListIterator
+	ListSecrets(req *smpb.ListSecretsRequest) SecretIterator
 	DestroySecretVersion(req *smpb.DestroySecretVersionRequest) (*smpb.SecretVersion, error)
+	DisableSecretVersion(req *smpb.DisableSecretVersionRequest) (*smpb.SecretVersion, error)
 	CreateSecret(req *smpb.CreateSecretRequest) (*smpb.Secret, error)
 	AddSecretVersion(req *smpb.AddSecretVersionRequest) (*smpb.SecretVersion, error)
 	DeleteSecret(req *smpb.DeleteSecretRequest) error
+	TestIamPermissions(req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error)
 	Close() error
 }
 
@@ -45,17 +59,42 @@ type SecretListIterator interface {
 	Next() (*smpb.SecretVersion, error)
 }
 
+// SecretIterator is an interface for the GRPC secret manager response from ListSecrets.
+// Like the GRPC iterator, Next returns iterator.Done once there are no more Secrets.
+type SecretIterator interface {
+	Next() (*smpb.Secret, error)
+}
+
 type secretClientImpl struct {
 	client *sm.Client
 	ctx    context.Context
 }
 
 // SecretClientFactoryImpl implements ClientFactory for the real GRPC client.
-type SecretClientFactoryImpl struct{}
+type SecretClientFactoryImpl struct {
+	// Location is the region whose Secret Manager endpoint is used.
+	// If empty, the global endpoint is used.
+	Location string
+}
 
 // NewSecretClient creates a GRPC NewClient for secretmanager.
-func (*SecretClientFactoryImpl) NewSecretClient(ctx context.Context) (SecretClient, error) {
-	c, err := sm.NewClient(ctx)
+// If EmulatorHostEnv is set, the client will talk to the emulator instead.
+func (f *SecretClientFactoryImpl) NewSecretClient(ctx context.Context) (SecretClient, error) {
+	var opts []option.ClientOption
+
+	if host := os.Getenv(EmulatorHostEnv); host != "" {
+		conn, err := grpc.DialContext(ctx, host, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to emulator at %v: %w", host, err)
+		}
+
+		// The client takes ownership of conn, and closes it on Close().
+		opts = append(opts, option.WithGRPCConn(conn))
+	} else if f.Location != "" {
+		opts = append(opts, option.WithEndpoint(RegionalEndpoint(f.Location)))
+	}
+
+	c, err := sm.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup client: %w", err)
 	}
@@ -63,15 +102,29 @@ func (*SecretClientFactoryImpl) NewSecretClient(ctx context.Context) (SecretClie
 	return &secretClientImpl{client: c, ctx: ctx}, nil
 }
 
+// RegionalEndpoint is the Secret Manager endpoint that serves regional secrets in location.
+func RegionalEndpoint(location string) string {
+	return fmt.Sprintf("secretmanager.%s.rep.googleapis.com:443", location)
+}
+
 func (sc *secretClientImpl) AccessSecretVersion(req *smpb.AccessSecretVersionRequest) (*smpb.AccessSecretVersionResponse, error) {
 	return sc.client.AccessSecretVersion(sc.ctx, req)
 }
+func (sc *secretClientImpl) GetSecretVersion(req *smpb.GetSecretVersionRequest) (*smpb.SecretVersion, error) {
+	return sc.client.GetSecretVersion(sc.ctx, req)
+}
 func (sc *secretClientImpl) ListSecretVersions(req *smpb.ListSecretVersionsRequest) SecretListIterator {
 	return sc.client.ListSecretVersions(sc.ctx, req)
 }
+func (sc *secretClientImpl) ListSecrets(req *smpb.ListSecretsRequest) SecretIterator {
+	return sc.client.ListSecrets(sc.ctx, req)
+}
 func (sc *secretClientImpl) DestroySecretVersion(req *smpb.DestroySecretVersionRequest) (*smpb.SecretVersion, error) {
 	return sc.client.DestroySecretVersion(sc.ctx, req)
 }
+func (sc *secretClientImpl) DisableSecretVersion(req *smpb.DisableSecretVersionRequest) (*smpb.SecretVersion, error) {
+	return sc.client.DisableSecretVersion(sc.ctx, req)
+}
 func (sc *secretClientImpl) CreateSecret(req *smpb.CreateSecretRequest) (*smpb.Secret, error) {
 	return sc.client.CreateSecret(sc.ctx, req)
 }
@@ -81,6 +134,9 @@ func (sc *secretClientImpl) AddSecretVersion(req *smpb.AddSecretVersionRequest)
 func (sc *secretClientImpl) DeleteSecret(req *smpb.DeleteSecretRequest) error {
 	return sc.client.DeleteSecret(sc.ctx, req)
 }
+func (sc *secretClientImpl) TestIamPermissions(req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	return sc.client.TestIamPermissions(sc.ctx, req)
+}
 
 func (sc *secretClientImpl) Close() error {
 	return sc.client.Close()
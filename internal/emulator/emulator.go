@@ -0,0 +1,492 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package emulator is a small, local implementation of the Secret Manager
+// GRPC service. It implements the operations smcache uses, and stores
+// secrets either in memory or in a local directory.
+//
+// It is not a complete or faithful copy of Secret Manager. IAM, replication
+// and rotation are ignored, etags are only set on SecretVersions (and not
+// checked), and every caller is allowed to do everything.
+// Expired secrets are hidden as if they had been deleted, but are only removed
+// from the store when they are next written to or deleted.
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The default and maximum page sizes used by the List calls.
+const (
+	defaultPageSize = 25000
+	maxPageSize     = 25000
+)
+
+// Same restrictions Secret Manager places on a secret ID.
+var /*const*/ secretIDPattern = regexp.MustCompile("^[a-zA-Z0-9-_]{1,255}$")
+
+// Server implements secretmanagerpb.SecretManagerServiceServer.
+// Use New to create one.
+type Server struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+
+	mu      sync.Mutex
+	secrets map[string]*secret
+	store   store
+}
+
+// secret is a Secret and all of its SecretVersions, oldest version first.
+type secret struct {
+	meta     *secretmanagerpb.Secret
+	versions []*version
+}
+
+// version is a SecretVersion and the payload stored within it.
+type version struct {
+	meta *secretmanagerpb.SecretVersion
+	data []byte
+}
+
+// New creates a Server. If dir is empty, all secrets are kept in memory and
+// lost when the process exits. Otherwise secrets are written to, and loaded
+// from, files within dir.
+func New(dir string) (*Server, error) {
+	var st store = memoryStore{}
+	if dir != "" {
+		st = &dirStore{dir: dir}
+	}
+
+	secrets, err := st.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+
+	return &Server{secrets: secrets, store: st}, nil
+}
+
+// CreateSecret creates a new Secret containing no SecretVersions.
+func (s *Server) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	if !secretIDPattern.MatchString(req.GetSecretId()) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid secret id [%v]", req.GetSecretId())
+	}
+
+	name := req.GetParent() + "/secrets/" + req.GetSecretId()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getSecret(name); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "Secret [%v] already exists.", name)
+	}
+
+	meta := proto.Clone(req.GetSecret()).(*secretmanagerpb.Secret)
+	if meta == nil {
+		meta = &secretmanagerpb.Secret{}
+	}
+
+	meta.Name = name
+	meta.CreateTime = timestamppb.Now()
+
+	// Secret Manager only ever returns the expire time, even if a TTL was given.
+	if ttl := meta.GetTtl(); ttl != nil {
+		meta.Expiration = &secretmanagerpb.Secret_ExpireTime{
+			ExpireTime: timestamppb.New(meta.GetCreateTime().AsTime().Add(ttl.AsDuration())),
+		}
+	}
+
+	sec := &secret{meta: meta}
+	if err := s.save(name, sec); err != nil {
+		return nil, err
+	}
+
+	return proto.Clone(meta).(*secretmanagerpb.Secret), nil
+}
+
+// AddSecretVersion adds a new SecretVersion containing the payload to an existing Secret.
+// If the payload has a CRC32C, it must match the data.
+func (s *Server) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	p := req.GetPayload()
+	checksummed := p != nil && p.DataCrc32C != nil
+
+	if checksummed && p.GetDataCrc32C() != crc32c(p.GetData()) {
+		return nil, status.Errorf(codes.InvalidArgument, "Checksum mismatch: data_crc32c [%d] does not match the data.",
+			p.GetDataCrc32C())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec, err := s.getSecret(req.GetParent())
+	if err != nil {
+		return nil, err
+	}
+
+	v := &version{
+		meta: &secretmanagerpb.SecretVersion{
+			Name:       fmt.Sprintf("%s/versions/%d", sec.meta.GetName(), len(sec.versions)+1),
+			CreateTime: timestamppb.Now(),
+			State:      secretmanagerpb.SecretVersion_ENABLED,
+			Etag:       newEtag(),
+
+			ClientSpecifiedPayloadChecksum: checksummed,
+		},
+		data: append([]byte(nil), p.GetData()...),
+	}
+	sec.versions = append(sec.versions, v)
+
+	if err := s.save(sec.meta.GetName(), sec); err != nil {
+		sec.versions = sec.versions[:len(sec.versions)-1]
+		return nil, err
+	}
+
+	return proto.Clone(v.meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+// AccessSecretVersion returns the payload of a SecretVersion. The "latest"
+// alias refers to the most recently created SecretVersion.
+func (s *Server) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, v, err := s.getVersion(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	if v.meta.GetState() != secretmanagerpb.SecretVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "SecretVersion [%v] is in %v state.",
+			v.meta.GetName(), v.meta.GetState())
+	}
+
+	crc := crc32c(v.data)
+
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name:    v.meta.GetName(),
+		Payload: &secretmanagerpb.SecretPayload{Data: append([]byte(nil), v.data...), DataCrc32C: &crc},
+	}, nil
+}
+
+// ListSecrets lists the Secrets within a project (or location), ordered by name.
+// The filter may only contain terms joined by AND. Each term is either "name:value",
+// which matches secrets whose ID contains the value, or "labels.key=value".
+func (s *Server) ListSecrets(ctx context.Context, req *secretmanagerpb.ListSecretsRequest) (*secretmanagerpb.ListSecretsResponse, error) {
+	match, err := parseFilter(req.GetFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+
+	for name, sec := range s.secrets {
+		if strings.TrimSuffix(name, "/secrets/"+secretID(name)) == req.GetParent() && !expired(sec) && match(sec) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	start, end, next, err := page(len(names), req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &secretmanagerpb.ListSecretsResponse{
+		NextPageToken: next,
+		TotalSize:     int32(len(names)),
+	}
+
+	for _, name := range names[start:end] {
+		resp.Secrets = append(resp.Secrets, proto.Clone(s.secrets[name].meta).(*secretmanagerpb.Secret))
+	}
+
+	return resp, nil
+}
+
+// GetSecretVersion returns the metadata of a SecretVersion, without its payload.
+// The "latest" alias refers to the most recently created SecretVersion.
+func (s *Server) GetSecretVersion(ctx context.Context, req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, v, err := s.getVersion(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Clone(v.meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+// ListSecretVersions lists the SecretVersions of a Secret, newest first.
+func (s *Server) ListSecretVersions(ctx context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec, err := s.getSecret(req.GetParent())
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, next, err := page(len(sec.versions), req.GetPageSize(), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &secretmanagerpb.ListSecretVersionsResponse{
+		NextPageToken: next,
+		TotalSize:     int32(len(sec.versions)),
+	}
+
+	for i := start; i < end; i++ {
+		v := sec.versions[len(sec.versions)-1-i]
+		resp.Versions = append(resp.Versions, proto.Clone(v.meta).(*secretmanagerpb.SecretVersion))
+	}
+
+	return resp, nil
+}
+
+// DestroySecretVersion irrevocably destroys the payload of a SecretVersion.
+func (s *Server) DestroySecretVersion(ctx context.Context, req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec, v, err := s.getVersion(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	if v.meta.GetState() == secretmanagerpb.SecretVersion_DESTROYED {
+		return nil, status.Errorf(codes.FailedPrecondition, "SecretVersion [%v] is already destroyed.", v.meta.GetName())
+	}
+
+	v.meta.State = secretmanagerpb.SecretVersion_DESTROYED
+	v.meta.DestroyTime = timestamppb.Now()
+	v.meta.Etag = newEtag()
+	v.data = nil
+
+	if err := s.save(sec.meta.GetName(), sec); err != nil {
+		return nil, err
+	}
+
+	return proto.Clone(v.meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+// DisableSecretVersion disables a SecretVersion, so its payload can't be accessed.
+func (s *Server) DisableSecretVersion(ctx context.Context, req *secretmanagerpb.DisableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sec, v, err := s.getVersion(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	if v.meta.GetState() == secretmanagerpb.SecretVersion_DESTROYED {
+		return nil, status.Errorf(codes.FailedPrecondition, "SecretVersion [%v] is destroyed.", v.meta.GetName())
+	}
+
+	v.meta.State = secretmanagerpb.SecretVersion_DISABLED
+	v.meta.Etag = newEtag()
+
+	if err := s.save(sec.meta.GetName(), sec); err != nil {
+		return nil, err
+	}
+
+	return proto.Clone(v.meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+// DeleteSecret deletes a Secret and all of its SecretVersions.
+func (s *Server) DeleteSecret(ctx context.Context, req *secretmanagerpb.DeleteSecretRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getSecret(req.GetName()); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.remove(req.GetName()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete secret: %v", err)
+	}
+
+	delete(s.secrets, req.GetName())
+
+	return &emptypb.Empty{}, nil
+}
+
+// TestIamPermissions reports that the caller has every permission it asks about,
+// as the emulator does not implement IAM.
+func (s *Server) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getSecret(req.GetResource()); err != nil {
+		return nil, err
+	}
+
+	return &iampb.TestIamPermissionsResponse{Permissions: req.GetPermissions()}, nil
+}
+
+// getSecret returns the Secret with the given resource name.
+// s.mu must be held.
+func (s *Server) getSecret(name string) (*secret, error) {
+	sec, ok := s.secrets[name]
+	if !ok || expired(sec) {
+		return nil, status.Errorf(codes.NotFound, "Secret [%v] not found or has no versions.", name)
+	}
+
+	return sec, nil
+}
+
+// getVersion returns the SecretVersion with the given resource name,
+// resolving the "latest" alias. s.mu must be held.
+func (s *Server) getVersion(name string) (*secret, *version, error) {
+	i := strings.LastIndex(name, "/versions/")
+	if i < 0 {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid secret version name [%v]", name)
+	}
+
+	sec, err := s.getSecret(name[:i])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := name[i+len("/versions/"):]
+	if id == "latest" {
+		if len(sec.versions) == 0 {
+			return nil, nil, status.Errorf(codes.NotFound, "Secret [%v] not found or has no versions.", name[:i])
+		}
+
+		return sec, sec.versions[len(sec.versions)-1], nil
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 || n > len(sec.versions) {
+		return nil, nil, status.Errorf(codes.NotFound, "SecretVersion [%v] not found.", name)
+	}
+
+	return sec, sec.versions[n-1], nil
+}
+
+// save persists sec to the store and records it in memory. s.mu must be held.
+func (s *Server) save(name string, sec *secret) error {
+	if err := s.store.save(name, sec); err != nil {
+		return status.Errorf(codes.Internal, "failed to save secret: %v", err)
+	}
+
+	s.secrets[name] = sec
+
+	return nil
+}
+
+// crc32c is the checksum Secret Manager uses for payloads.
+func crc32c(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// newEtag returns a new, quoted, etag. Every change to a SecretVersion gets a new one.
+func newEtag() string {
+	return fmt.Sprintf("%q", strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// expired reports if sec has passed its expire time.
+func expired(sec *secret) bool {
+	et := sec.meta.GetExpireTime()
+	return et != nil && !time.Now().Before(et.AsTime())
+}
+
+// secretID returns the last segment of a secret's resource name.
+func secretID(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// parseFilter returns a func that reports if a secret matches a ListSecrets filter.
+func parseFilter(filter string) (func(*secret) bool, error) {
+	var (
+		names  []string
+		labels = map[string]string{}
+	)
+
+	for _, term := range strings.Split(filter, " AND ") {
+		term = strings.TrimSpace(term)
+
+		if name, ok := strings.CutPrefix(term, "name:"); ok {
+			names = append(names, name)
+		} else if label, ok := strings.CutPrefix(term, "labels."); ok && strings.Contains(label, "=") {
+			k, v, _ := strings.Cut(label, "=")
+			labels[k] = v
+		} else if term != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported filter [%v]", filter)
+		}
+	}
+
+	return func(sec *secret) bool {
+		for _, n := range names {
+			if !strings.Contains(secretID(sec.meta.GetName()), n) {
+				return false
+			}
+		}
+
+		for k, v := range labels {
+			if l, ok := sec.meta.GetLabels()[k]; !ok || l != v {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+// page works out the [start, end) range of a list of n items that should be
+// returned for a page request, and the token for the following page.
+func page(n int, size int32, token string) (start, end int, next string, err error) {
+	if token != "" {
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > n {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid page token [%v]", token)
+		}
+	}
+
+	if size <= 0 {
+		size = defaultPageSize
+	}
+
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+
+	end = start + int(size)
+	if end >= n {
+		return start, n, "", nil
+	}
+
+	return start, end, strconv.Itoa(end), nil
+}
@@ -0,0 +1,371 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jwendel/smcache"
+	"github.com/jwendel/smcache/internal/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// startEmulator serves srv on a local port, and points smcache at it.
+func startEmulator(t *testing.T, srv *Server) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	gs := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(gs, srv)
+
+	go func() { _ = gs.Serve(lis) }()
+
+	t.Cleanup(gs.Stop)
+	t.Setenv(api.EmulatorHostEnv, lis.Addr().String())
+}
+
+func TestEmulator_smcacheRoundTrip(t *testing.T) {
+	srv, err := New("")
+	require.NoError(t, err)
+	startEmulator(t, srv)
+
+	ctx := context.Background()
+	cache := smcache.NewSMCache(smcache.Config{ProjectID: "test-project", SecretPrefix: "test-"})
+
+	report, err := cache.Preflight(ctx)
+	assert.NoError(t, err)
+	assert.False(t, report.ProbeLeft)
+
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+
+	assert.NoError(t, cache.Put(ctx, "example.com", []byte("first")))
+	assert.NoError(t, cache.Put(ctx, "example.com", []byte("second")))
+
+	data, err := cache.Get(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), data)
+
+	// The first version should have been destroyed by the second Put.
+	_, err = srv.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/test-project/secrets/test-example_com/versions/1",
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	assert.NoError(t, cache.Delete(ctx, "example.com"))
+	assert.NoError(t, cache.Delete(ctx, "example.com"))
+
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestEmulator_smcacheDeleteModes(t *testing.T) {
+	srv, err := New("")
+	require.NoError(t, err)
+	startEmulator(t, srv)
+
+	ctx := context.Background()
+
+	modes := map[smcache.DeleteMode]secretmanagerpb.SecretVersion_State{
+		smcache.DeleteModeDestroyVersions: secretmanagerpb.SecretVersion_DESTROYED,
+		smcache.DeleteModeDisableVersions: secretmanagerpb.SecretVersion_DISABLED,
+	}
+
+	for mode, state := range modes {
+		cache := smcache.NewSMCache(smcache.Config{
+			ProjectID: "test-project", SecretPrefix: string(mode) + "-", DeleteMode: mode,
+		})
+
+		require.NoError(t, cache.Put(ctx, "example.com", []byte("first")))
+		require.NoError(t, cache.Delete(ctx, "example.com"))
+
+		_, err = cache.Get(ctx, "example.com")
+		assert.Equal(t, autocert.ErrCacheMiss, err, mode)
+
+		// The secret is kept, and can be written to again.
+		v, err := srv.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+			Name: "projects/test-project/secrets/" + string(mode) + "-example_com/versions/1",
+		})
+		require.NoError(t, err, mode)
+		assert.Equal(t, state, v.GetState(), mode)
+
+		require.NoError(t, cache.Put(ctx, "example.com", []byte("second")))
+
+		data, err := cache.Get(ctx, "example.com")
+		assert.NoError(t, err, mode)
+		assert.Equal(t, []byte("second"), data, mode)
+	}
+}
+
+func TestEmulator_dirStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	srv, err := New(dir)
+	require.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	require.NoError(t, err)
+	_, err = srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  "projects/p/secrets/s",
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("data")},
+	})
+	require.NoError(t, err)
+
+	// A new emulator on the same directory should see the same secrets.
+	srv, err = New(dir)
+	require.NoError(t, err)
+
+	resp, err := srv.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/p/secrets/s/versions/latest",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "projects/p/secrets/s/versions/1", resp.GetName())
+	assert.Equal(t, []byte("data"), resp.GetPayload().GetData())
+
+	_, err = srv.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: "projects/p/secrets/s"})
+	require.NoError(t, err)
+
+	srv, err = New(dir)
+	require.NoError(t, err)
+
+	_, err = srv.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: "projects/p/secrets/s/versions/latest",
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestEmulator_createErrors(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "bad.id"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	assert.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestEmulator_listPaging(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  "projects/p/secrets/s",
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte("data")},
+		})
+		require.NoError(t, err)
+	}
+
+	resp, err := srv.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: "projects/p/secrets/s", PageSize: 2,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.GetVersions(), 2)
+	assert.Equal(t, "projects/p/secrets/s/versions/3", resp.GetVersions()[0].GetName())
+	assert.Equal(t, "projects/p/secrets/s/versions/2", resp.GetVersions()[1].GetName())
+
+	resp, err = srv.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: "projects/p/secrets/s", PageSize: 2, PageToken: resp.GetNextPageToken(),
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.GetVersions(), 1)
+	assert.Equal(t, "projects/p/secrets/s/versions/1", resp.GetVersions()[0].GetName())
+	assert.Empty(t, resp.GetNextPageToken())
+}
+
+func TestEmulator_listSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	for _, id := range []string{"b_http-01", "a_http-01", "example_com"} {
+		_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: id})
+		require.NoError(t, err)
+	}
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/q", SecretId: "c_http-01"})
+	require.NoError(t, err)
+
+	resp, err := srv.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: "projects/p", Filter: "name:_http-01"})
+	require.NoError(t, err)
+	require.Len(t, resp.GetSecrets(), 2)
+	assert.Equal(t, "projects/p/secrets/a_http-01", resp.GetSecrets()[0].GetName())
+	assert.Equal(t, "projects/p/secrets/b_http-01", resp.GetSecrets()[1].GetName())
+
+	_, err = srv.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: "projects/p", Filter: "labels.a>b"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestEmulator_expiration(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	s, err := srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/p",
+		SecretId: "s",
+		Secret:   &secretmanagerpb.Secret{Expiration: &secretmanagerpb.Secret_Ttl{Ttl: durationpb.New(time.Hour)}},
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, s.GetExpireTime())
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/p",
+		SecretId: "expired",
+		Secret:   &secretmanagerpb.Secret{Expiration: &secretmanagerpb.Secret_Ttl{Ttl: durationpb.New(-time.Second)}},
+	})
+	require.NoError(t, err)
+
+	_, err = srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{Parent: "projects/p/secrets/expired"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	resp, err := srv.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: "projects/p"})
+	require.NoError(t, err)
+	require.Len(t, resp.GetSecrets(), 1)
+	assert.Equal(t, "projects/p/secrets/s", resp.GetSecrets()[0].GetName())
+}
+
+func TestEmulator_getSecretVersion(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	require.NoError(t, err)
+	_, err = srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{Parent: "projects/p/secrets/s"})
+	require.NoError(t, err)
+
+	latest := &secretmanagerpb.GetSecretVersionRequest{Name: "projects/p/secrets/s/versions/latest"}
+
+	before, err := srv.GetSecretVersion(ctx, latest)
+	require.NoError(t, err)
+	assert.Equal(t, "projects/p/secrets/s/versions/1", before.GetName())
+	assert.NotEmpty(t, before.GetEtag())
+
+	_, err = srv.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{Name: before.GetName()})
+	require.NoError(t, err)
+
+	after, err := srv.GetSecretVersion(ctx, latest)
+	require.NoError(t, err)
+	assert.Equal(t, secretmanagerpb.SecretVersion_DESTROYED, after.GetState())
+	assert.NotEqual(t, before.GetEtag(), after.GetEtag())
+}
+
+func TestEmulator_smcacheKeys(t *testing.T) {
+	srv, err := New("")
+	require.NoError(t, err)
+	startEmulator(t, srv)
+
+	ctx := context.Background()
+	web := smcache.NewSMCache(smcache.Config{
+		ProjectID: "test-project", SecretPrefix: "test-", Labels: map[string]string{"app": "web"},
+	})
+	other := smcache.NewSMCache(smcache.Config{
+		ProjectID: "test-project", SecretPrefix: "test-", Labels: map[string]string{"app": "api"},
+	})
+
+	require.NoError(t, web.Put(ctx, "example.com", []byte("cert")))
+	require.NoError(t, web.Put(ctx, "example.com+rsa", []byte("cert")))
+	require.NoError(t, other.Put(ctx, "api.example.com", []byte("cert")))
+
+	var keys []string
+
+	it := web.Keys(ctx, &smcache.ListOptions{Labels: map[string]string{"app": "web"}, PageSize: 1})
+	for {
+		k, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		require.NoError(t, err)
+		keys = append(keys, k)
+	}
+
+	assert.Equal(t, []string{"example.com", "example.com+rsa"}, keys)
+}
+
+func TestEmulator_disableSecretVersion(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	require.NoError(t, err)
+	_, err = srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{Parent: "projects/p/secrets/s"})
+	require.NoError(t, err)
+
+	v, err := srv.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: "projects/p/secrets/s/versions/1"})
+	require.NoError(t, err)
+	assert.Equal(t, secretmanagerpb.SecretVersion_DISABLED, v.GetState())
+
+	_, err = srv.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: "projects/p/secrets/s/versions/latest"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestEmulator_checksum(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := New("")
+	require.NoError(t, err)
+
+	_, err = srv.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/p", SecretId: "s"})
+	require.NoError(t, err)
+
+	bad := int64(1)
+	_, err = srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  "projects/p/secrets/s",
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("data"), DataCrc32C: &bad},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	good := crc32c([]byte("data"))
+	v, err := srv.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  "projects/p/secrets/s",
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("data"), DataCrc32C: &good},
+	})
+	require.NoError(t, err)
+	assert.True(t, v.GetClientSpecifiedPayloadChecksum())
+
+	resp, err := srv.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: v.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, good, resp.GetPayload().GetDataCrc32C())
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// store persists secrets outside of the Server's memory.
+type store interface {
+	load() (map[string]*secret, error)
+	save(name string, sec *secret) error
+	remove(name string) error
+}
+
+// memoryStore does not persist anything, secrets only live in the Server.
+type memoryStore struct{}
+
+func (memoryStore) load() (map[string]*secret, error) { return map[string]*secret{}, nil }
+func (memoryStore) save(string, *secret) error        { return nil }
+func (memoryStore) remove(string) error               { return nil }
+
+// dirStore persists each secret as a JSON file within dir.
+type dirStore struct {
+	dir string
+}
+
+const fileSuffix = ".json"
+
+// fileSecret is the on-disk format of a secret.
+type fileSecret struct {
+	Secret   json.RawMessage `json:"secret"`
+	Versions []fileVersion   `json:"versions,omitempty"`
+}
+
+type fileVersion struct {
+	Version json.RawMessage `json:"version"`
+	Data    []byte          `json:"data,omitempty"`
+}
+
+func (ds *dirStore) load() (map[string]*secret, error) {
+	if err := os.MkdirAll(ds.dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := map[string]*secret{}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), fileSuffix) {
+			continue
+		}
+
+		sec, err := ds.read(filepath.Join(ds.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %w", e.Name(), err)
+		}
+
+		secrets[sec.meta.GetName()] = sec
+	}
+
+	return secrets, nil
+}
+
+func (ds *dirStore) read(path string) (*secret, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f fileSecret
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	sec := &secret{meta: &secretmanagerpb.Secret{}}
+	if err := protojson.Unmarshal(f.Secret, sec.meta); err != nil {
+		return nil, err
+	}
+
+	for _, fv := range f.Versions {
+		v := &version{meta: &secretmanagerpb.SecretVersion{}, data: fv.Data}
+		if err := protojson.Unmarshal(fv.Version, v.meta); err != nil {
+			return nil, err
+		}
+
+		sec.versions = append(sec.versions, v)
+	}
+
+	return sec, nil
+}
+
+func (ds *dirStore) save(name string, sec *secret) error {
+	var (
+		f   fileSecret
+		err error
+	)
+
+	f.Secret, err = protojson.Marshal(sec.meta)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range sec.versions {
+		fv := fileVersion{Data: v.data}
+
+		fv.Version, err = protojson.Marshal(v.meta)
+		if err != nil {
+			return err
+		}
+
+		f.Versions = append(f.Versions, fv)
+	}
+
+	b, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash never leaves a partial secret behind.
+	tmp, err := os.CreateTemp(ds.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), ds.path(name))
+}
+
+func (ds *dirStore) remove(name string) error {
+	err := os.Remove(ds.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// path is the file a secret is stored in. Resource names contain slashes,
+// so they are escaped to make a single file name.
+func (ds *dirStore) path(name string) string {
+	return filepath.Join(ds.dir, url.QueryEscape(name)+fileSuffix)
+}
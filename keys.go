@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import "strings"
+
+// The keys autocert stores in its Cache are built from these.
+// See golang.org/x/crypto/acme/autocert for where they come from.
+const (
+	// accountKey is the key of the ACME account's private key.
+	accountKey = "acme_account+key"
+	// rsaSuffix is added to a domain for its RSA certificate.
+	rsaSuffix = "+rsa"
+	// tokenSuffix is added to a domain for its tls-alpn-01 challenge certificate.
+	tokenSuffix = "+token"
+	// httpTokenSuffix is added to an http-01 challenge token (not a domain).
+	httpTokenSuffix = "+http-01"
+)
+
+// managedLabel is set on every secret smcache creates, so the secrets it stores
+// can be told apart from others in the project. Secrets created by older
+// versions of smcache don't have it.
+const (
+	managedLabel      = "smcache-managed"
+	managedLabelValue = "true"
+)
+
+// keyDomain returns the domain an unsanitized autocert key belongs to, by
+// removing any suffix autocert added. Keys that don't belong to a domain,
+// such as the ACME account key and http-01 tokens, are returned unchanged.
+func keyDomain(key string) string {
+	for _, suffix := range []string{rsaSuffix, tokenSuffix} {
+		if strings.HasSuffix(key, suffix) {
+			return strings.TrimSuffix(key, suffix)
+		}
+	}
+
+	return key
+}
+
+// maxSecretIDLength is the longest secret ID Secret Manager allows. sanitize
+// truncates keys to fit, so a key this long may not be the whole key.
+const maxSecretIDLength = 255
+
+// keyFromSecretID reverses sanitize for the keys autocert uses, given the
+// sanitized key (the secret ID without its prefix). exact is false if the key
+// can't be known for sure, because sanitize truncated it, or because it is not
+// one autocert would store.
+//
+// autocert only stores lowercase domain names (which never contain "_"), the
+// ACME account key and http-01 tokens, so "_" can be turned back into "." or
+// "+". Tokens are base64url, which sanitize leaves unchanged.
+func keyFromSecretID(prefix, key string) (string, bool) {
+	if len(prefix)+len(key) >= maxSecretIDLength {
+		return key, false
+	}
+
+	if key == sanitize(accountKey) {
+		return accountKey, true
+	}
+
+	if token := strings.TrimSuffix(key, sanitize(httpTokenSuffix)); token != key {
+		return token + httpTokenSuffix, true
+	}
+
+	if strings.ToLower(key) != key {
+		return key, false
+	}
+
+	for _, suffix := range []string{rsaSuffix, tokenSuffix} {
+		if domain := strings.TrimSuffix(key, sanitize(suffix)); domain != key {
+			return strings.ReplaceAll(domain, "_", ".") + suffix, true
+		}
+	}
+
+	// A domain has at least two labels.
+	if !strings.Contains(key, "_") {
+		return key, false
+	}
+
+	return strings.ReplaceAll(key, "_", "."), true
+}
@@ -0,0 +1,467 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
+	"github.com/jwendel/smcache/internal/api"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// Limit caps one kind of call an SMCache makes to Secret Manager, to stay
+// within the project's quotas. See Config.ReadLimit and Config.WriteLimit.
+type Limit struct {
+	// PerSecond is the sustained rate of calls allowed.
+	// Optional, defaults to 0, which does not limit the rate.
+	PerSecond float64
+
+	// Burst is how many calls can be made at once after a quiet period, above
+	// the PerSecond rate.
+	// Optional, defaults to PerSecond rounded up.
+	Burst int
+
+	// MaxInFlight is how many calls can be in progress at once.
+	// Optional, defaults to 0, which does not limit concurrent calls.
+	MaxInFlight int
+}
+
+func (l Limit) check(name string, problems []string) []string {
+	if l.PerSecond < 0 || math.IsNaN(l.PerSecond) || math.IsInf(l.PerSecond, 0) {
+		problems = append(problems, fmt.Sprintf("%s.PerSecond must be a number that is not negative", name))
+	}
+
+	if l.Burst < 0 {
+		problems = append(problems, fmt.Sprintf("%s.Burst must not be negative", name))
+	}
+
+	if l.Burst > 0 && l.PerSecond == 0 {
+		problems = append(problems, fmt.Sprintf("%s.Burst requires %s.PerSecond", name, name))
+	}
+
+	if l.MaxInFlight < 0 {
+		problems = append(problems, fmt.Sprintf("%s.MaxInFlight must not be negative", name))
+	}
+
+	return problems
+}
+
+// limiter enforces a Limit with a token bucket and a semaphore. A nil limiter
+// allows every call.
+type limiter struct {
+	perSecond float64
+	burst     float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	slots chan struct{}
+}
+
+// newLimiter returns the limiter for l, or nil if l doesn't limit anything.
+func newLimiter(l Limit) *limiter {
+	if l.PerSecond <= 0 && l.MaxInFlight <= 0 {
+		return nil
+	}
+
+	lim := &limiter{perSecond: l.PerSecond, burst: float64(l.Burst)}
+	if lim.burst == 0 {
+		lim.burst = math.Max(1, math.Ceil(l.PerSecond))
+	}
+
+	lim.tokens = lim.burst
+	lim.last = time.Now()
+
+	if l.MaxInFlight > 0 {
+		lim.slots = make(chan struct{}, l.MaxInFlight)
+	}
+
+	return lim
+}
+
+// acquire waits until a call is allowed, or ctx is done. The returned func must
+// be called once the call has finished.
+func (lim *limiter) acquire(ctx context.Context) (func(), error) {
+	if lim == nil {
+		return func() {}, nil
+	}
+
+	if err := lim.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	if lim.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case lim.slots <- struct{}{}:
+		return func() { <-lim.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait takes a token from the bucket, waiting for one to be added if it's empty.
+func (lim *limiter) wait(ctx context.Context) error {
+	if lim.perSecond <= 0 {
+		return nil
+	}
+
+	lim.mu.Lock()
+	now := time.Now()
+	lim.tokens = math.Min(lim.burst, lim.tokens+now.Sub(lim.last).Seconds()*lim.perSecond)
+	lim.last = now
+
+	// Take the token now, even if it's only added later, so waiting callers queue up.
+	lim.tokens--
+	delay := time.Duration(-lim.tokens / lim.perSecond * float64(time.Second))
+	lim.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back for the callers queued behind this one.
+		lim.mu.Lock()
+		lim.tokens++
+		lim.mu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// newClient returns a SecretClient for ctx, which applies ReadLimit and WriteLimit.
+func (smc *SMCache) newClient(ctx context.Context) (api.SecretClient, error) {
+	client, err := smc.cf.NewSecretClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reads, writes := smc.limiters()
+	if reads == nil && writes == nil {
+		return client, nil
+	}
+
+	return &limitedClient{SecretClient: client, ctx: ctx, reads: reads, writes: writes}, nil
+}
+
+// limiters returns the limiters for ReadLimit and WriteLimit, either of which may be nil.
+func (smc *SMCache) limiters() (reads, writes *limiter) {
+	smc.limitersOnce.Do(func() {
+		smc.reads = newLimiter(smc.ReadLimit)
+		smc.writes = newLimiter(smc.WriteLimit)
+	})
+
+	return smc.reads, smc.writes
+}
+
+// limitedClient waits for its limiters before each call to Secret Manager.
+// Listing counts each page it reads as a call, see limitedIterator.
+type limitedClient struct {
+	api.SecretClient
+
+	ctx           context.Context
+	reads, writes *limiter
+}
+
+func (c *limitedClient) read(kind string) (func(), error) {
+	release, err := c.reads.acquire(c.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting to %v: %w", kind, err)
+	}
+
+	return release, nil
+}
+
+func (c *limitedClient) write(kind string) (func(), error) {
+	release, err := c.writes.acquire(c.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting to %v: %w", kind, err)
+	}
+
+	return release, nil
+}
+
+func (c *limitedClient) AccessSecretVersion(req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	release, err := c.read("access secret version")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.AccessSecretVersion(req)
+}
+
+func (c *limitedClient) GetSecretVersion(req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	release, err := c.read("get secret version")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.GetSecretVersion(req)
+}
+
+// The listing RPCs are made by Next, so the limit is taken there rather than here.
+func (c *limitedClient) ListSecretVersions(req *secretmanagerpb.ListSecretVersionsRequest) api.SecretListIterator {
+	it := c.SecretClient.ListSecretVersions(req)
+	return &limitedIterator[*secretmanagerpb.SecretVersion]{next: it.Next, page: pageInfo(it), c: c, kind: "list secret versions"}
+}
+
+func (c *limitedClient) ListSecrets(req *secretmanagerpb.ListSecretsRequest) api.SecretIterator {
+	it := c.SecretClient.ListSecrets(req)
+	return &limitedIterator[*secretmanagerpb.Secret]{next: it.Next, page: pageInfo(it), c: c, kind: "list secrets"}
+}
+
+func (c *limitedClient) TestIamPermissions(req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	release, err := c.read("test IAM permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.TestIamPermissions(req)
+}
+
+func (c *limitedClient) CreateSecret(req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	release, err := c.write("create secret")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.CreateSecret(req)
+}
+
+func (c *limitedClient) AddSecretVersion(req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	release, err := c.write("add secret version")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.AddSecretVersion(req)
+}
+
+func (c *limitedClient) DestroySecretVersion(req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	release, err := c.write("destroy secret version")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.DestroySecretVersion(req)
+}
+
+func (c *limitedClient) DisableSecretVersion(req *secretmanagerpb.DisableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	release, err := c.write("disable secret version")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SecretClient.DisableSecretVersion(req)
+}
+
+func (c *limitedClient) DeleteSecret(req *secretmanagerpb.DeleteSecretRequest) error {
+	release, err := c.write("delete secret")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return c.SecretClient.DeleteSecret(req)
+}
+
+// limitedIterator takes the read limiter around each call to Next that may fetch
+// a page. The GRPC iterators report through PageInfo whether items are buffered;
+// for other iterators (page is nil), every call to Next is limited.
+type limitedIterator[T any] struct {
+	next func() (T, error)
+	page func() *iterator.PageInfo
+
+	c    *limitedClient
+	kind string
+}
+
+func (it *limitedIterator[T]) Next() (T, error) {
+	if it.page == nil || it.page().Remaining() == 0 {
+		release, err := it.c.read(it.kind)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		defer release()
+	}
+
+	return it.next()
+}
+
+// pageInfo returns the PageInfo method, or nil if it has none.
+func pageInfo(it interface{}) func() *iterator.PageInfo {
+	if p, ok := it.(interface{ PageInfo() *iterator.PageInfo }); ok {
+		return p.PageInfo
+	}
+
+	return nil
+}
+
+// limitedBackend applies ReadLimit and WriteLimit to a Config.Backend.
+type limitedBackend struct {
+	Backend
+
+	reads, writes *limiter
+}
+
+func (b limitedBackend) Open(ctx context.Context) (BackendConn, error) {
+	conn, err := b.Backend.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &limitedConn{BackendConn: conn, ctx: ctx, reads: b.reads, writes: b.writes}, nil
+}
+
+// limitedConn waits for its limiters before each call to the Backend.
+type limitedConn struct {
+	BackendConn
+
+	ctx           context.Context
+	reads, writes *limiter
+}
+
+func (c *limitedConn) read(kind string) (func(), error) {
+	release, err := c.reads.acquire(c.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting to %v: %w", kind, err)
+	}
+
+	return release, nil
+}
+
+func (c *limitedConn) write(kind string) (func(), error) {
+	release, err := c.writes.acquire(c.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting to %v: %w", kind, err)
+	}
+
+	return release, nil
+}
+
+func (c *limitedConn) AccessLatest(secret string) ([]byte, string, error) {
+	release, err := c.read("access secret version")
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+
+	return c.BackendConn.AccessLatest(secret)
+}
+
+func (c *limitedConn) LatestVersion(secret string) (Version, error) {
+	release, err := c.read("get secret version")
+	if err != nil {
+		return Version{}, err
+	}
+	defer release()
+
+	return c.BackendConn.LatestVersion(secret)
+}
+
+func (c *limitedConn) ListVersions(secret string) ([]Version, error) {
+	release, err := c.read("list secret versions")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.BackendConn.ListVersions(secret)
+}
+
+// ListSecrets implements BackendLister, failing if the wrapped BackendConn doesn't.
+func (c *limitedConn) ListSecrets(parent, prefix string, labels map[string]string) ([]SecretInfo, error) {
+	release, err := c.read("list secrets")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return listSecrets(c.BackendConn, parent, prefix, labels)
+}
+
+func (c *limitedConn) CreateSecret(secret string, opts SecretOptions) error {
+	release, err := c.write("create secret")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return c.BackendConn.CreateSecret(secret, opts)
+}
+
+func (c *limitedConn) AddVersion(secret string, data []byte) (string, error) {
+	release, err := c.write("add secret version")
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	return c.BackendConn.AddVersion(secret, data)
+}
+
+func (c *limitedConn) DestroyVersion(version string) error {
+	release, err := c.write("destroy secret version")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return c.BackendConn.DestroyVersion(version)
+}
+
+func (c *limitedConn) DisableVersion(version string) error {
+	release, err := c.write("disable secret version")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return c.BackendConn.DisableVersion(version)
+}
+
+func (c *limitedConn) DeleteSecret(secret string) error {
+	release, err := c.write("delete secret")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return c.BackendConn.DeleteSecret(secret)
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+func TestLimiter_rate(t *testing.T) {
+	lim := newLimiter(Limit{PerSecond: 100, Burst: 2})
+	ctx := context.Background()
+
+	// The burst is allowed straight away, then calls are spaced out to the rate.
+	start := time.Now()
+
+	for i := 0; i < 7; i++ {
+		release, err := lim.acquire(ctx)
+		assert.Nil(t, err)
+		release()
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), 45*time.Millisecond)
+}
+
+func TestLimiter_cancel(t *testing.T) {
+	lim := newLimiter(Limit{PerSecond: 0.001})
+
+	release, err := lim.acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = lim.acquire(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestLimiter_none(t *testing.T) {
+	assert.Nil(t, newLimiter(Limit{}))
+
+	var lim *limiter
+
+	release, err := lim.acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+}
+
+func TestLimitedClient_maxInFlight(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	const callers = 10
+
+	var inFlight, most int32
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).DoAndReturn(
+		func(*secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+
+			return &secretmanagerpb.AccessSecretVersionResponse{Payload: checksummed([]byte("cert"))}, nil
+		}).Times(callers)
+	m.EXPECT().Close().Times(callers)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", ReadLimit: Limit{MaxInFlight: 2}, DebugLogging: debug}, m)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		// Different keys, so the Gets aren't shared.
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := cache.Get(context.Background(), string(rune('a'+i))+".example.com")
+			assert.Nil(t, err)
+		}(i)
+	}
+
+	wg.Wait()
+	assert.LessOrEqual(t, atomic.LoadInt32(&most), int32(2))
+}
+
+func TestLimitedClient_writeBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().DeleteSecret(gomock.Any()).Return(nil)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{Payload: checksummed([]byte("cert"))}, nil)
+	m.EXPECT().Close().Times(3)
+
+	cache := newCacheWithMockGrpc(Config{
+		ProjectID: "projId", WriteLimit: Limit{PerSecond: 0.001}, Timeout: 20 * time.Millisecond, DebugLogging: debug,
+	}, m)
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Delete(ctx, "example.com"))
+
+	// The write budget is spent, but reads have their own.
+	err := cache.Delete(ctx, "example.com")
+	assert.EqualError(t, err, "problem while deleting secret [projects/projId/secrets/example_com]. "+
+		"waiting to delete secret: context deadline exceeded")
+
+	_, err = cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+}
+
+// blockingSecrets is a listing whose Next blocks until release is closed.
+type blockingSecrets struct {
+	inFlight *int32
+	entered  chan struct{}
+	release  chan struct{}
+}
+
+func (it *blockingSecrets) Next() (*secretmanagerpb.Secret, error) {
+	atomic.AddInt32(it.inFlight, 1)
+	defer atomic.AddInt32(it.inFlight, -1)
+
+	it.entered <- struct{}{}
+	<-it.release
+
+	return nil, iterator.Done
+}
+
+func TestLimitedClient_listInFlight(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var inFlight int32
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&blockingSecrets{&inFlight, entered, release}).Times(3)
+
+	c := &limitedClient{SecretClient: m, ctx: context.Background(), reads: newLimiter(Limit{MaxInFlight: 1})}
+
+	// A listing that is never read doesn't hold a slot.
+	c.ListSecrets(&secretmanagerpb.ListSecretsRequest{})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 2; i++ {
+		it := c.ListSecrets(&secretmanagerpb.ListSecretsRequest{})
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := it.Next()
+			assert.Equal(t, iterator.Done, err)
+		}()
+	}
+
+	// Only one Next fetches at a time.
+	<-entered
+	assert.Never(t, func() bool { return atomic.LoadInt32(&inFlight) > 1 }, 20*time.Millisecond, time.Millisecond)
+
+	close(release)
+	<-entered
+	wg.Wait()
+}
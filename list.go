@@ -0,0 +1,307 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jwendel/smcache/internal/api"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// ListOptions narrows down the secrets listed by Keys and Entries.
+type ListOptions struct {
+	// Labels only lists secrets that have every one of these labels.
+	// Optional, defaults to all secrets.
+	Labels map[string]string
+
+	// PageSize is how many secrets are fetched from Secret Manager at a time.
+	// Optional, defaults to the Secret Manager default.
+	PageSize int32
+}
+
+// Entry describes one secret that smcache stores.
+type Entry struct {
+	// Key is the autocert key stored in the secret, such as "example.com+rsa".
+	Key string
+	// Exact is false if Key was truncated to fit in a secret ID, in which case
+	// Key is the sanitized (and truncated) key rather than the autocert key. It
+	// is also false for secrets that may not be smcache's at all: those whose ID
+	// is not one autocert would use and, when SecretPrefix is empty, those that
+	// are not Managed.
+	Exact bool
+	// Managed is true if smcache created the secret, as shown by its
+	// "smcache-managed" label. Older versions of smcache did not set it.
+	Managed bool
+	// SecretName is the resource name of the secret.
+	SecretName string
+	// Labels are the secret's labels.
+	Labels map[string]string
+	// CreateTime is when the secret was created.
+	CreateTime time.Time
+	// ExpireTime is when Secret Manager will delete the secret, or the zero Time
+	// if it does not expire.
+	ExpireTime time.Time
+}
+
+// EntryIterator iterates over the secrets under SecretPrefix. Use Entries to create one.
+type EntryIterator struct {
+	ctx    context.Context
+	opts   ListOptions
+	caches []*SMCache
+
+	// The listing of the current cache, nil before it starts. client is nil
+	// for a Config.Backend, which is listed all at once.
+	cache  *SMCache
+	client api.SecretClient
+	next   func() (SecretInfo, error)
+	err    error
+}
+
+// Entries lists the secrets under SecretPrefix. The preflight secret, and an
+// AccountKey stored under a different project or prefix, are not listed.
+// Secrets are filtered by prefix and label on the server, and fetched a page at a time.
+// If Config.Backend is set, its connections must implement BackendLister.
+//
+// The listing needs secretmanager.secrets.list on the project.
+func (smc *SMCache) Entries(ctx context.Context, opts *ListOptions) *EntryIterator {
+	return newEntryIterator(ctx, opts, []*SMCache{smc})
+}
+
+// Keys lists the autocert keys stored under SecretPrefix. See Entries.
+func (smc *SMCache) Keys(ctx context.Context, opts *ListOptions) *KeyIterator {
+	return &KeyIterator{entries: smc.Entries(ctx, opts)}
+}
+
+func newEntryIterator(ctx context.Context, opts *ListOptions, caches []*SMCache) *EntryIterator {
+	it := &EntryIterator{ctx: ctx, caches: caches}
+	if opts != nil {
+		it.opts = *opts
+	}
+
+	return it
+}
+
+// Next returns the next Entry. Its second return value is iterator.Done
+// (from google.golang.org/api/iterator) if there are no more entries.
+// Once Next returns an error, every following call returns the same error.
+func (it *EntryIterator) Next() (Entry, error) {
+	for it.err == nil {
+		if it.next == nil {
+			if len(it.caches) == 0 {
+				it.err = iterator.Done
+				break
+			}
+
+			it.start()
+
+			continue
+		}
+
+		s, err := it.next()
+		if errors.Is(err, iterator.Done) {
+			it.stopCurrent()
+			continue
+		}
+
+		if err != nil {
+			it.err = fmt.Errorf("failed to list secrets. %w", err)
+			break
+		}
+
+		if e, ok := it.cache.entryFor(s); ok {
+			return e, nil
+		}
+	}
+
+	it.Stop()
+
+	return Entry{}, it.err
+}
+
+// Stop releases the connection to Secret Manager. It only needs to be called
+// if the iterator is abandoned before Next returns an error.
+func (it *EntryIterator) Stop() {
+	it.stopCurrent()
+	it.caches = nil
+}
+
+// start begins listing the next cache.
+func (it *EntryIterator) start() {
+	smc := it.caches[0]
+	it.caches = it.caches[1:]
+
+	if err := smc.resolveProjectID(it.ctx); err != nil {
+		it.err = err
+		return
+	}
+
+	parent := smc.secretsParent(smc.policyFor(""))
+	smc.logf("Listing secrets in [%v] with prefix [%v]", parent, smc.SecretPrefix)
+
+	if smc.Backend != nil {
+		it.startBackend(smc, parent)
+		return
+	}
+
+	client, err := smc.newClient(it.ctx)
+	if err != nil {
+		it.err = fmt.Errorf("failed to setup client: %w", err)
+		return
+	}
+
+	secrets := client.ListSecrets(&secretmanagerpb.ListSecretsRequest{
+		Parent:   parent,
+		PageSize: it.opts.PageSize,
+		Filter:   listFilter(smc.SecretPrefix, it.opts.Labels),
+	})
+
+	it.cache = smc
+	it.client = client
+	it.next = func() (SecretInfo, error) {
+		s, err := secrets.Next()
+		if err == nil && s == nil {
+			err = iterator.Done
+		}
+
+		if err != nil {
+			return SecretInfo{}, err
+		}
+
+		return secretInfo(s), nil
+	}
+}
+
+// startBackend lists Config.Backend, which must implement BackendLister.
+func (it *EntryIterator) startBackend(smc *SMCache, parent string) {
+	conn, err := smc.backend().Open(it.ctx)
+	if err != nil {
+		it.err = fmt.Errorf("failed to setup client: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	secrets, err := listSecrets(conn, parent, smc.SecretPrefix, it.opts.Labels)
+	if err != nil {
+		it.err = fmt.Errorf("failed to list secrets. %w", err)
+		return
+	}
+
+	it.cache = smc
+	it.next = func() (SecretInfo, error) {
+		if len(secrets) == 0 {
+			return SecretInfo{}, iterator.Done
+		}
+
+		s := secrets[0]
+		secrets = secrets[1:]
+
+		return s, nil
+	}
+}
+
+func (it *EntryIterator) stopCurrent() {
+	if it.client != nil {
+		it.client.Close()
+	}
+
+	it.cache, it.client, it.next = nil, nil, nil
+}
+
+// secretInfo describes a Secret listed from Secret Manager.
+func secretInfo(s *secretmanagerpb.Secret) SecretInfo {
+	info := SecretInfo{
+		Name:       s.GetName(),
+		Labels:     s.GetLabels(),
+		CreateTime: s.GetCreateTime().AsTime(),
+	}
+
+	if et := s.GetExpireTime(); et != nil {
+		info.ExpireTime = et.AsTime()
+	}
+
+	return info
+}
+
+// listFilter builds the ListSecrets filter for secrets with prefix and labels.
+// Secret Manager's "name:" matches anywhere in the name, so the prefix is
+// checked again when each secret is returned.
+func listFilter(prefix string, labels map[string]string) string {
+	var terms []string
+	if prefix != "" {
+		terms = append(terms, "name:"+prefix)
+	}
+
+	for k, v := range labels {
+		terms = append(terms, fmt.Sprintf("labels.%s=%s", k, v))
+	}
+
+	// Map iteration is random, keep the filter stable.
+	sort.Strings(terms)
+
+	return strings.Join(terms, " AND ")
+}
+
+// entryFor returns the Entry for a listed secret, if it is one smcache stores.
+func (smc *SMCache) entryFor(s SecretInfo) (Entry, bool) {
+	id := s.Name[strings.LastIndex(s.Name, "/")+1:]
+	if !strings.HasPrefix(id, smc.SecretPrefix) {
+		return Entry{}, false
+	}
+
+	key := strings.TrimPrefix(id, smc.SecretPrefix)
+	if key == "" || key == preflightSecretID {
+		return Entry{}, false
+	}
+
+	e := Entry{
+		SecretName: s.Name,
+		Labels:     s.Labels,
+		CreateTime: s.CreateTime,
+		ExpireTime: s.ExpireTime,
+		Managed:    s.Labels[managedLabel] == managedLabelValue,
+	}
+	e.Key, e.Exact = keyFromSecretID(smc.SecretPrefix, key)
+
+	// Without a prefix, any secret in the project is listed.
+	if smc.SecretPrefix == "" && !e.Managed {
+		e.Exact = false
+	}
+
+	return e, true
+}
+
+// KeyIterator iterates over the autocert keys under SecretPrefix. Use Keys to create one.
+type KeyIterator struct {
+	entries *EntryIterator
+}
+
+// Next returns the next key. Its second return value is iterator.Done
+// if there are no more keys. Keys that were truncated are returned sanitized.
+func (it *KeyIterator) Next() (string, error) {
+	e, err := it.entries.Next()
+	return e.Key, err
+}
+
+// Stop releases the connection to Secret Manager. See EntryIterator.Stop.
+func (it *KeyIterator) Stop() {
+	it.entries.Stop()
+}
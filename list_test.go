@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestKeyFromSecretID(t *testing.T) {
+	check := func(id, want string) {
+		t.Helper()
+
+		key, exact := keyFromSecretID("", id)
+		assert.True(t, exact)
+		assert.Equal(t, want, key)
+	}
+
+	check("example_com", "example.com")
+	check("www_example_com_rsa", "www.example.com+rsa")
+	check("example_com_token", "example.com+token")
+	check("acme_account_key", "acme_account+key")
+	check("ab_c-d_http-01", "ab_c-d+http-01")
+	check("xn--bcher-kva_example", "xn--bcher-kva.example")
+
+	// Round trip every kind of key through sanitize.
+	for _, k := range []string{"a.b.example.com", "example.com+rsa", "example.com+token", "tok_en-1+http-01", accountKey} {
+		check(sanitize(k), k)
+	}
+
+	key, exact := keyFromSecretID("test-", strings.Repeat("a", 250))
+	assert.False(t, exact)
+	assert.Equal(t, strings.Repeat("a", 250), key)
+
+	// Secrets autocert would never have stored.
+	for _, id := range []string{"DB_PASSWORD", "localhost"} {
+		key, exact := keyFromSecretID("", id)
+		assert.False(t, exact, id)
+		assert.Equal(t, id, key)
+	}
+}
+
+func TestEntries_noPrefix(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		managedSecret("projects/projId/secrets/example_com"),
+		{Name: "projects/projId/secrets/db_password"},
+	}})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	it := cache.Entries(context.Background(), nil)
+
+	e, err := it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", e.Key)
+	assert.True(t, e.Exact)
+	assert.True(t, e.Managed)
+
+	// Without a prefix, only the label shows a secret is smcache's.
+	e, err = it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "db.password", e.Key)
+	assert.False(t, e.Exact)
+	assert.False(t, e.Managed)
+
+	_, err = it.Next()
+	assert.Equal(t, iterator.Done, err)
+}
+
+func TestEntries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	created := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	expires := created.Add(time.Hour)
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Eq(&secretmanagerpb.ListSecretsRequest{
+		Parent:   "projects/projId",
+		PageSize: 50,
+		Filter:   "labels.app=web AND name:test-",
+	})).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		{
+			Name:       "projects/projId/secrets/test-example_com",
+			Labels:     map[string]string{"app": "web"},
+			CreateTime: timestamppb.New(created),
+		},
+		{Name: "projects/projId/secrets/test-smcache-preflight"},
+		{Name: "projects/projId/secrets/other-test-example_com"},
+		{
+			Name:       "projects/projId/secrets/test-abc_http-01",
+			CreateTime: timestamppb.New(created),
+			Expiration: &secretmanagerpb.Secret_ExpireTime{ExpireTime: timestamppb.New(expires)},
+		},
+	}})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", SecretPrefix: "test-", DebugLogging: debug}, m)
+	it := cache.Entries(context.Background(), &ListOptions{Labels: map[string]string{"app": "web"}, PageSize: 50})
+
+	e, err := it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, Entry{
+		Key:        "example.com",
+		Exact:      true,
+		SecretName: "projects/projId/secrets/test-example_com",
+		Labels:     map[string]string{"app": "web"},
+		CreateTime: created,
+	}, e)
+
+	e, err = it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc+http-01", e.Key)
+	assert.Equal(t, expires, e.ExpireTime)
+
+	_, err = it.Next()
+	assert.Equal(t, iterator.Done, err)
+
+	_, err = it.Next()
+	assert.Equal(t, iterator.Done, err)
+}
+
+func TestKeys_error(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&sliErrorSecrets{})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	it := cache.Keys(context.Background(), nil)
+
+	_, err := it.Next()
+	assert.EqualError(t, err, "failed to list secrets. rpc error: code = PermissionDenied desc = denied")
+}
+
+func TestRouter_Keys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Eq(&secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/project-zero",
+		Filter: "name:zero-",
+	})).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		{Name: "projects/project-zero/secrets/zero-a_example"},
+	}})
+	m.EXPECT().ListSecrets(gomock.Eq(&secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/project-one",
+		Filter: "name:one-",
+	})).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		{Name: "projects/project-one/secrets/one-b_example"},
+		{Name: "projects/project-one/secrets/one-b_example_rsa"},
+	}})
+	m.EXPECT().Close().Times(2)
+
+	r, err := NewRouter([]Config{
+		{ProjectID: "project-zero", SecretPrefix: "zero-"},
+		{ProjectID: "project-one", SecretPrefix: "one-"},
+	}, nil)
+	assert.Nil(t, err)
+	withMockShards(r, m)
+
+	var keys []string
+
+	it := r.Keys(context.Background(), nil)
+	for {
+		k, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+
+		assert.Nil(t, err)
+		keys = append(keys, k)
+	}
+
+	assert.Equal(t, []string{"a.example", "b.example", "b.example+rsa"}, keys)
+}
+
+// sliErrorSecrets is a SecretIterator that always fails.
+type sliErrorSecrets struct{}
+
+func (s *sliErrorSecrets) Next() (*secretmanagerpb.Secret, error) {
+	return nil, status.Error(codes.PermissionDenied, "denied")
+}
+
+// managedLabels are the labels smcache sets on the secrets it creates.
+func managedLabels() map[string]string {
+	return map[string]string{managedLabel: managedLabelValue}
+}
+
+// managedSecret is a listed secret that smcache created.
+func managedSecret(name string) *secretmanagerpb.Secret {
+	return &secretmanagerpb.Secret{Name: name, Labels: managedLabels()}
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is a Backend that keeps secrets in memory, for tests and for
+// processes that don't need their certificates to outlive them. Secrets created
+// with a TTL are removed once it passes. It is safe for concurrent use.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	secrets map[string]*memSecret
+}
+
+type memSecret struct {
+	versions []memVersion // oldest first
+	created  time.Time
+	expires  time.Time // zero for never
+	opts     SecretOptions
+}
+
+type memVersion struct {
+	data    []byte
+	state   VersionState
+	created time.Time
+	changes int // times state changed, for the etag
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{secrets: make(map[string]*memSecret)}
+}
+
+// Open implements Backend. ctx is ignored, as nothing blocks.
+func (b *MemoryBackend) Open(ctx context.Context) (BackendConn, error) {
+	return b, nil
+}
+
+// Options returns the SecretOptions the secret was created with.
+func (b *MemoryBackend) Options(secret string) (SecretOptions, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, err := b.secret(secret)
+	if err != nil {
+		return SecretOptions{}, err
+	}
+
+	return s.opts, nil
+}
+
+func (b *MemoryBackend) AccessLatest(secret string) ([]byte, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, err := b.secret(secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	n := len(s.versions)
+	if n == 0 || s.versions[n-1].state != VersionEnabled {
+		return nil, "", fmt.Errorf("%w: secret [%v] has no enabled latest version", ErrNotFound, secret)
+	}
+
+	data := append([]byte(nil), s.versions[n-1].data...)
+
+	return data, memVersionName(secret, n), nil
+}
+
+func (b *MemoryBackend) ListVersions(secret string) ([]Version, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, err := b.secret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(s.versions))
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		versions = append(versions, s.version(secret, i+1))
+	}
+
+	return versions, nil
+}
+
+func (b *MemoryBackend) LatestVersion(secret string) (Version, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, err := b.secret(secret)
+	if err != nil {
+		return Version{}, err
+	}
+
+	if len(s.versions) == 0 {
+		return Version{}, fmt.Errorf("%w: secret [%v] has no versions", ErrNotFound, secret)
+	}
+
+	return s.version(secret, len(s.versions)), nil
+}
+
+// ListSecrets implements BackendLister. Secrets are returned in name order.
+func (b *MemoryBackend) ListSecrets(parent, prefix string, labels map[string]string) ([]SecretInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var infos []SecretInfo
+
+	for name := range b.secrets {
+		id, ok := strings.CutPrefix(name, parent+"/secrets/")
+		if !ok || !strings.HasPrefix(id, prefix) || strings.Contains(id, "/") {
+			continue
+		}
+
+		s, err := b.secret(name)
+		if err != nil || !hasLabels(s.opts.Labels, labels) {
+			continue
+		}
+
+		infos = append(infos, SecretInfo{
+			Name:       name,
+			Labels:     s.opts.Labels,
+			CreateTime: s.created,
+			ExpireTime: s.expires,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos, nil
+}
+
+// hasLabels reports whether have includes every one of want.
+func hasLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := have[k]; !ok || got != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *MemoryBackend) CreateSecret(secret string, opts SecretOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.secret(secret); err == nil {
+		return fmt.Errorf("secret [%v] already exists", secret)
+	}
+
+	s := &memSecret{opts: opts, created: time.Now()}
+	if opts.TTL > 0 {
+		s.expires = s.created.Add(opts.TTL)
+	}
+
+	b.secrets[secret] = s
+
+	return nil
+}
+
+func (b *MemoryBackend) AddVersion(secret string, data []byte) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, err := b.secret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	s.versions = append(s.versions, memVersion{data: append([]byte(nil), data...), created: time.Now()})
+
+	return memVersionName(secret, len(s.versions)), nil
+}
+
+func (b *MemoryBackend) DestroyVersion(version string) error {
+	return b.setState(version, VersionDestroyed)
+}
+
+func (b *MemoryBackend) DisableVersion(version string) error {
+	return b.setState(version, VersionDisabled)
+}
+
+func (b *MemoryBackend) DeleteSecret(secret string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.secret(secret); err != nil {
+		return err
+	}
+
+	delete(b.secrets, secret)
+
+	return nil
+}
+
+// Close implements BackendConn, and does nothing.
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+// secret returns the named secret, removing it first if its TTL has passed.
+// b.mu must be held.
+func (b *MemoryBackend) secret(name string) (*memSecret, error) {
+	s, ok := b.secrets[name]
+	if ok && !s.expires.IsZero() && !time.Now().Before(s.expires) {
+		delete(b.secrets, name)
+		ok = false
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: secret [%v]", ErrNotFound, name)
+	}
+
+	return s, nil
+}
+
+func (b *MemoryBackend) setState(version string, state VersionState) error {
+	secret, n, err := parseMemVersionName(version)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, err := b.secret(secret)
+	if err != nil {
+		return err
+	}
+
+	if n < 1 || n > len(s.versions) {
+		return fmt.Errorf("%w: version [%v]", ErrNotFound, version)
+	}
+
+	v := &s.versions[n-1]
+	if v.state == VersionDestroyed {
+		if state != VersionDestroyed {
+			return fmt.Errorf("version [%v] is destroyed", version)
+		}
+
+		return nil
+	}
+
+	if v.state != state {
+		v.state = state
+		v.changes++
+	}
+
+	if state == VersionDestroyed {
+		v.data = nil
+	}
+
+	return nil
+}
+
+// version describes the nth version of the secret.
+func (s *memSecret) version(secret string, n int) Version {
+	v := s.versions[n-1]
+	return Version{
+		Name:       memVersionName(secret, n),
+		State:      v.state,
+		CreateTime: v.created,
+		Etag:       strconv.Quote(strconv.Itoa(v.changes)),
+	}
+}
+
+// memVersionName names the nth version of secret, counting from 1 as Secret Manager does.
+func memVersionName(secret string, n int) string {
+	return fmt.Sprintf("%s/versions/%d", secret, n)
+}
+
+func parseMemVersionName(version string) (string, int, error) {
+	i := strings.LastIndex(version, "/versions/")
+	if i < 0 {
+		return "", 0, fmt.Errorf("%w: version [%v]", ErrNotFound, version)
+	}
+
+	n, err := strconv.Atoi(version[i+len("/versions/"):])
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: version [%v]", ErrNotFound, version)
+	}
+
+	return version[:i], n, nil
+}
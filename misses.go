@@ -0,0 +1,136 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxMisses caps how many keys missCache remembers, so random names can't
+	// grow it without bound. Forgetting a miss only costs another read.
+	maxMisses = 10000
+
+	// missSweepEvery is how many adds missCache waits between dropping expired misses.
+	missSweepEvery = 256
+)
+
+// missCache remembers keys that Get found missing, for Config.MissCacheTTL.
+type missCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+
+	// writes counts calls to remove. A miss read before a write started may
+	// be out of date, so add ignores it (see since).
+	writes uint64
+
+	// adds counts calls to add since expired misses were last dropped.
+	adds int
+}
+
+// has reports whether key was recently found missing.
+func (mc *missCache) has(key string) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	expires, ok := mc.expires[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expires) {
+		delete(mc.expires, key)
+		return false
+	}
+
+	return true
+}
+
+// since returns a marker to pass to add, taken before reading key.
+func (mc *missCache) since() uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	return mc.writes
+}
+
+// add remembers key as missing for ttl, unless remove was called after since
+// returned marker.
+func (mc *missCache) add(key string, ttl time.Duration, marker uint64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.writes != marker {
+		return
+	}
+
+	if mc.expires == nil {
+		mc.expires = map[string]time.Time{}
+	}
+
+	now := time.Now()
+
+	mc.adds++
+	if mc.adds >= missSweepEvery {
+		mc.adds = 0
+		mc.sweep(now)
+	}
+
+	// Full, so forget any one miss.
+	if _, ok := mc.expires[key]; !ok && len(mc.expires) >= maxMisses {
+		for k := range mc.expires {
+			delete(mc.expires, k)
+			break
+		}
+	}
+
+	mc.expires[key] = now.Add(ttl)
+}
+
+// sweep drops the misses expired at now. mc.mu must be held.
+func (mc *missCache) sweep(now time.Time) {
+	for k, expires := range mc.expires {
+		if now.After(expires) {
+			delete(mc.expires, k)
+		}
+	}
+}
+
+// remove forgets that key was missing.
+func (mc *missCache) remove(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.writes++
+	delete(mc.expires, key)
+}
+
+// len returns how many keys are remembered as missing.
+func (mc *missCache) len() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+
+	for _, expires := range mc.expires {
+		if !now.After(expires) {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGet_missCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	notFound := status.Error(codes.NotFound, "not found")
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	gomock.InOrder(
+		m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, notFound),
+		m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}),
+		m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, nil),
+		m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, notFound),
+	)
+	m.EXPECT().Close().AnyTimes()
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", MissCacheTTL: time.Minute, DebugLogging: debug}, m)
+	ctx := context.Background()
+
+	// The second Get is answered from memory.
+	for i := 0; i < 2; i++ {
+		_, err := cache.Get(ctx, "example.com")
+		assert.Equal(t, autocert.ErrCacheMiss, err)
+	}
+
+	// Put forgets the miss, so the next Get goes to Secret Manager again.
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+
+	_, err := cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestGet_missCacheExpires(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, status.Error(codes.NotFound, "not found")).Times(2)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", MissCacheTTL: time.Millisecond, DebugLogging: debug}, m)
+
+	_, err := cache.Get(context.Background(), "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = cache.Get(context.Background(), "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestGet_missCacheDisabled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, status.Error(codes.NotFound, "not found")).Times(2)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.Get(context.Background(), "example.com")
+		assert.Equal(t, autocert.ErrCacheMiss, err)
+	}
+}
+
+func TestMissCache_staleAdd(t *testing.T) {
+	var mc missCache
+
+	// A miss read before a Put finished must not be remembered after it.
+	marker := mc.since()
+	mc.remove("example.com")
+	mc.add("example.com", time.Minute, marker)
+	assert.False(t, mc.has("example.com"))
+
+	mc.add("example.com", time.Minute, mc.since())
+	assert.True(t, mc.has("example.com"))
+
+	mc.remove("example.com")
+	assert.False(t, mc.has("example.com"))
+}
+
+func TestMissCache_bounded(t *testing.T) {
+	var mc missCache
+
+	// Expired misses are dropped every missSweepEvery adds.
+	for i := 0; i < missSweepEvery-1; i++ {
+		mc.add(fmt.Sprint("expired", i), -time.Second, mc.since())
+	}
+	assert.Len(t, mc.expires, missSweepEvery-1)
+
+	mc.add("example.com", time.Minute, mc.since())
+	assert.Len(t, mc.expires, 1)
+	assert.True(t, mc.has("example.com"))
+
+	// Live misses are capped at maxMisses.
+	for i := 0; i < maxMisses+10; i++ {
+		mc.add(fmt.Sprint("live", i), time.Minute, mc.since())
+	}
+	assert.Len(t, mc.expires, maxMisses)
+	assert.True(t, mc.has(fmt.Sprint("live", maxMisses+9)))
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// ErrIntegrity is returned when the data read from Secret Manager does not match
+// the checksum Secret Manager returned with it.
+var ErrIntegrity = errors.New("smcache: payload failed integrity check")
+
+// crc32cTable is the Castagnoli table Secret Manager uses for payload checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newPayload wraps stored data in a SecretPayload, along with its CRC32C so
+// Secret Manager rejects it if it is corrupted on the way.
+func newPayload(stored []byte) *secretmanagerpb.SecretPayload {
+	crc := int64(crc32.Checksum(stored, crc32cTable))
+	return &secretmanagerpb.SecretPayload{Data: stored, DataCrc32C: &crc}
+}
+
+// verifyPayload checks the payload's CRC32C, if Secret Manager returned one,
+// and returns the data as stored.
+func verifyPayload(p *secretmanagerpb.SecretPayload) ([]byte, error) {
+	if p != nil && p.DataCrc32C != nil {
+		if got := int64(crc32.Checksum(p.GetData(), crc32cTable)); got != p.GetDataCrc32C() {
+			return nil, fmt.Errorf("%w: CRC32C is %d, but Secret Manager sent %d", ErrIntegrity, got, p.GetDataCrc32C())
+		}
+	}
+
+	return p.GetData(), nil
+}
+
+// gzipMagic starts every payload compressed by Put. autocert stores PEM text,
+// which never starts with a NUL byte, so legacy payloads can't be mistaken for it.
+var gzipMagic = []byte("\x00smcz")
+
+// maxDecodedSize bounds how large a compressed payload may grow when it is
+// decompressed. Payloads are at most 64 KiB, and certificates a few KiB.
+const maxDecodedSize = 4 << 20
+
+// encodePayload returns the data Put was given for key, as it should be stored
+// in a SecretVersion.
+func (smc *SMCache) encodePayload(key string, data []byte) ([]byte, error) {
+	if smc.Envelope {
+		return smc.seal(key, data)
+	}
+
+	if !smc.Compress {
+		return data, nil
+	}
+
+	compressed, err := gzipBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte(nil), gzipMagic...), compressed...), nil
+}
+
+// decodePayload reverses encodePayload. Payloads without a header are
+// returned unchanged, whatever the Config is set to.
+func decodePayload(payload []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(payload, envelopeMagic):
+		_, data, err := OpenEnvelope(payload)
+		return data, err
+	case bytes.HasPrefix(payload, gzipMagic):
+		return gunzipBytes(payload[len(gzipMagic):])
+	default:
+		return payload, nil
+	}
+}
+
+// gzipBytes compresses data with gzip.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress payload. %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress payload. %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// gunzipBytes decompresses gzip data, up to maxDecodedSize bytes.
+func gunzipBytes(compressed []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload. %w", err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(zr, maxDecodedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload. %w", err)
+	}
+
+	if len(data) > maxDecodedSize {
+		return nil, fmt.Errorf("decompressed payload is larger than %d bytes", maxDecodedSize)
+	}
+
+	return data, nil
+}
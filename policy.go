@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrReadOnly is returned by Put and Delete for keys whose KeyPolicy is ReadOnly.
+var ErrReadOnly = errors.New("smcache: key is read-only")
+
+// KeyPolicy controls where and how one class of autocert keys is stored,
+// separately from the certificates described by the rest of the Config.
+type KeyPolicy struct {
+	// ProjectID is the GCP Project ID to store these keys in.
+	// Optional, defaults to Config.ProjectID.
+	ProjectID string
+
+	// SecretPrefix is put before the secret name of these keys.
+	// Optional, defaults to Config.SecretPrefix.
+	SecretPrefix string
+
+	// KMSKeyName is the Cloud KMS key that encrypts these secrets.
+	// Optional, defaults to Config.KMSKeyName.
+	KMSKeyName string
+
+	// If true, smcache will not delete old SecretVersions of these keys.
+	// Unlike the fields above, this does not default to the Config.
+	KeepOldVersions bool
+
+	// If true, Put and Delete return ErrReadOnly for these keys, so this
+	// process can only read them. Use it to stop replicas creating or
+	// replacing a key that is managed elsewhere.
+	ReadOnly bool
+}
+
+// keyPolicy is the KeyPolicy of a key, with defaults applied from the Config.
+type keyPolicy struct {
+	projectID       string
+	secretPrefix    string
+	kmsKeyName      string
+	keepOldVersions bool
+	readOnly        bool
+	// ttl, if set, is how long Secret Manager keeps the secret before deleting it.
+	ttl time.Duration
+}
+
+// policyFor returns the policy that applies to a sanitized key.
+// The ProjectID must already be resolved.
+func (smc *SMCache) policyFor(key string) keyPolicy {
+	p := keyPolicy{
+		projectID:       smc.projectID(),
+		secretPrefix:    smc.SecretPrefix,
+		kmsKeyName:      smc.KMSKeyName,
+		keepOldVersions: smc.KeepOldCertificates,
+	}
+
+	if key == sanitize(accountKey) && smc.AccountKey != nil {
+		p.override(smc.AccountKey)
+	}
+
+	// http-01 tokens are written once, and only needed until the challenge is answered.
+	if isHTTPToken(key) {
+		p.keepOldVersions = true
+		p.ttl = smc.httpTokenTTL()
+	}
+
+	return p
+}
+
+// override replaces the defaults in p with any set in kp.
+func (p *keyPolicy) override(kp *KeyPolicy) {
+	if kp.ProjectID != "" {
+		p.projectID = kp.ProjectID
+	}
+
+	if kp.SecretPrefix != "" {
+		p.secretPrefix = kp.SecretPrefix
+	}
+
+	if kp.KMSKeyName != "" {
+		p.kmsKeyName = kp.KMSKeyName
+	}
+
+	p.keepOldVersions = kp.KeepOldVersions
+	p.readOnly = kp.ReadOnly
+}
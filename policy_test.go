@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+var accountKeyConfig = Config{
+	ProjectID:    "cert-project",
+	SecretPrefix: "certs-",
+	KMSKeyName:   "projects/cert-project/locations/global/keyRings/r/cryptoKeys/certs",
+	AccountKey: &KeyPolicy{
+		ProjectID:       "account-project",
+		SecretPrefix:    "acme-",
+		KMSKeyName:      "projects/account-project/locations/global/keyRings/r/cryptoKeys/account",
+		KeepOldVersions: true,
+	},
+	DebugLogging: debug,
+}
+
+func TestPut_accountKey_NewSecret(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("private key")
+	secretPath := "projects/account-project/secrets/acme-acme_account_key"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFakeNotFound{})
+	m.EXPECT().CreateSecret(&secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/account-project",
+		SecretId: "acme-acme_account_key",
+		Secret: &secretmanagerpb.Secret{
+			Labels: map[string]string{managedLabel: managedLabelValue},
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{
+					Automatic: &secretmanagerpb.Replication_Automatic{
+						CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{
+							KmsKeyName: "projects/account-project/locations/global/keyRings/r/cryptoKeys/account",
+						},
+					},
+				},
+			},
+		},
+	}).Return(nil, nil)
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secretPath,
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(accountKeyConfig, m)
+	err := cache.Put(context.Background(), "acme_account+key", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestPut_accountKey_keepOldVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("private key")
+	secretPath := "projects/account-project/secrets/acme-acme_account_key"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFake{secrets: []*secretmanagerpb.SecretVersion{{Name: secretPath + "/versions/1"}}})
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secretPath,
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	// No DestroySecretVersion, as the account key keeps old versions.
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(accountKeyConfig, m)
+	err := cache.Put(context.Background(), "acme_account+key", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestPut_certificate_usesDefaultPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("cert")
+	secretPath := "projects/cert-project/secrets/certs-example_com"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFakeNotFound{})
+	m.EXPECT().CreateSecret(&secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/cert-project",
+		SecretId: "certs-example_com",
+		Secret: &secretmanagerpb.Secret{
+			Labels: map[string]string{managedLabel: managedLabelValue},
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{
+					Automatic: &secretmanagerpb.Replication_Automatic{
+						CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{
+							KmsKeyName: "projects/cert-project/locations/global/keyRings/r/cryptoKeys/certs",
+						},
+					},
+				},
+			},
+		},
+	}).Return(nil, nil)
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secretPath,
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(accountKeyConfig, m)
+	err := cache.Put(context.Background(), "example.com", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestAccountKey_readOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("private key")
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Eq(
+		&secretmanagerpb.AccessSecretVersionRequest{
+			Name: "projects/account-project/secrets/acme_account_key/versions/latest",
+		})).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{
+			Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		}, nil)
+	m.EXPECT().Close().Times(1)
+
+	config := Config{
+		ProjectID:    "cert-project",
+		AccountKey:   &KeyPolicy{ProjectID: "account-project", ReadOnly: true},
+		DebugLogging: debug,
+	}
+	cache := newCacheWithMockGrpc(config, m)
+
+	result, err := cache.Get(context.Background(), "acme_account+key")
+	assert.Nil(t, err)
+	assert.Equal(t, secret, result)
+
+	err = cache.Put(context.Background(), "acme_account+key", secret)
+	assert.True(t, errors.Is(err, ErrReadOnly))
+
+	err = cache.Delete(context.Background(), "acme_account+key")
+	assert.True(t, errors.Is(err, ErrReadOnly))
+}
+
+func TestNewSMCache_accountKeyPrefix(t *testing.T) {
+	ak := &KeyPolicy{SecretPrefix: "acme."}
+	cache := NewSMCache(Config{AccountKey: ak})
+
+	assert.Equal(t, "acme_", cache.AccountKey.SecretPrefix)
+	assert.Equal(t, "acme.", ak.SecretPrefix, "the caller's KeyPolicy should not be changed")
+}
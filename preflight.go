@@ -0,0 +1,213 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
+	"github.com/jwendel/smcache/internal/api"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// preflightSecretID is the secret (after SecretPrefix) that Preflight creates,
+// tests permissions against and deletes again. It never holds any SecretVersions.
+const preflightSecretID = "smcache-preflight"
+
+// PreflightReport describes what Preflight found.
+type PreflightReport struct {
+	// SecretName is the secret permissions were tested against.
+	SecretName string
+	// Granted are the permissions the caller holds on SecretName.
+	Granted []string
+	// Missing are the permissions smcache needs, but the caller does not hold.
+	Missing []MissingPermission
+	// ProbeLeft is set if Preflight created SecretName but could not delete it
+	// afterwards, for example without secretmanager.secrets.delete. It is empty,
+	// and can be deleted by hand.
+	ProbeLeft bool
+}
+
+// MissingPermission is an IAM permission smcache needs, but does not have.
+type MissingPermission struct {
+	// Permission is the IAM permission, such as "secretmanager.versions.add".
+	Permission string
+	// Operation is the smcache operation that needs it, one of Get, Put or Delete.
+	Operation string
+	// Role is the narrowest predefined role that grants Permission.
+	Role string
+}
+
+func (mp MissingPermission) String() string {
+	return fmt.Sprintf("%s (needed by %s, granted by %s)", mp.Permission, mp.Operation, mp.Role)
+}
+
+// permissionCheck is a permission that Get, Put or Delete need on each secret.
+type permissionCheck struct {
+	permission string
+	operation  string
+	role       string
+}
+
+// requiredPermissions returns the permissions smcache needs on each secret with this Config.
+// secretmanager.secrets.create is not listed, as it is granted on the project rather than
+// a secret. Preflight checks it by creating a secret instead.
+func (c Config) requiredPermissions() []permissionCheck {
+	checks := []permissionCheck{
+		{"secretmanager.versions.access", "Get", "roles/secretmanager.secretAccessor"},
+		{"secretmanager.versions.list", "Put", "roles/secretmanager.viewer"},
+		{"secretmanager.versions.add", "Put", "roles/secretmanager.secretVersionAdder"},
+	}
+
+	if !c.KeepOldCertificates {
+		checks = append(checks,
+			permissionCheck{"secretmanager.versions.destroy", "Put", "roles/secretmanager.secretVersionManager"})
+	}
+
+	// Deleting versions also lists them, which Put already needs.
+	switch c.DeleteMode {
+	case DeleteModeDestroyVersions:
+		if c.KeepOldCertificates {
+			checks = append(checks,
+				permissionCheck{"secretmanager.versions.destroy", "Delete", "roles/secretmanager.secretVersionManager"})
+		}
+	case DeleteModeDisableVersions:
+		checks = append(checks,
+			permissionCheck{"secretmanager.versions.disable", "Delete", "roles/secretmanager.secretVersionManager"})
+	default:
+		checks = append(checks,
+			permissionCheck{"secretmanager.secrets.delete", "Delete", "roles/secretmanager.admin"})
+	}
+
+	return checks
+}
+
+// Preflight checks that smcache is able to work, so a deployment can fail early
+// rather than on the first TLS handshake. It validates the Config, confirms the
+// project is reachable, and tests that the caller holds every IAM permission
+// that Get, Put and Delete need on secrets under SecretPrefix. A separate
+// AccountKey policy is not checked.
+//
+// Preflight changes the project: to test permissions with any IAM conditions on
+// the prefix, it creates an empty secret named SecretPrefix+"smcache-preflight",
+// and deletes it again once done. This needs secretmanager.secrets.create, as Put
+// does, and secretmanager.secrets.delete, which only the default DeleteMode
+// needs otherwise. A probe secret that already existed is used, and left in place.
+//
+// A non-nil error is returned if any check fails. The report is returned whenever
+// permissions could be tested, and lists each missing permission with a role that grants it.
+func (smc *SMCache) Preflight(ctx context.Context) (*PreflightReport, error) {
+	if err := smc.requireSecretManager("Preflight"); err != nil {
+		return nil, err
+	}
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := smc.Config.Validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := smc.newClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer client.Close()
+
+	report := &PreflightReport{SecretName: smc.secretName(preflightSecretID)}
+	smc.logf("Preflight testing permissions on: %v", report.SecretName)
+
+	conn := secretManagerConn{client: client, location: smc.Location}
+	err = conn.CreateSecret(report.SecretName, smc.secretOptions(smc.policyFor(preflightSecretID)))
+	if err != nil {
+		err = fmt.Errorf("failed to create Secret. %w", err)
+	}
+
+	switch status.Code(err) {
+	case codes.OK:
+		defer smc.deleteProbe(client, report)
+	case codes.AlreadyExists:
+	case codes.PermissionDenied:
+		// Without the secret there is nothing else to test against.
+		report.Missing = append(report.Missing, MissingPermission{
+			Permission: "secretmanager.secrets.create",
+			Operation:  "Put",
+			Role:       "roles/secretmanager.admin",
+		})
+
+		return report, report.err()
+	default:
+		return nil, fmt.Errorf("project [%v] is not reachable: %w", smc.projectID(), err)
+	}
+
+	checks := smc.requiredPermissions()
+	req := &iampb.TestIamPermissionsRequest{Resource: report.SecretName}
+
+	for _, c := range checks {
+		req.Permissions = append(req.Permissions, c.permission)
+	}
+
+	resp, err := client.TestIamPermissions(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to test permissions on [%v]: %w", report.SecretName, err)
+	}
+
+	report.Granted = resp.GetPermissions()
+
+	granted := map[string]bool{}
+	for _, p := range report.Granted {
+		granted[p] = true
+	}
+
+	for _, c := range checks {
+		if !granted[c.permission] {
+			report.Missing = append(report.Missing, MissingPermission{
+				Permission: c.permission,
+				Operation:  c.operation,
+				Role:       c.role,
+			})
+		}
+	}
+
+	return report, report.err()
+}
+
+// deleteProbe deletes the secret Preflight created, recording in the report if it can't.
+func (smc *SMCache) deleteProbe(client api.SecretClient, report *PreflightReport) {
+	err := client.DeleteSecret(&secretmanagerpb.DeleteSecretRequest{Name: report.SecretName})
+	if err != nil && status.Code(err) != codes.NotFound {
+		smc.logf("Preflight could not delete [%v]: %v", report.SecretName, err)
+		report.ProbeLeft = true
+	}
+}
+
+// err summarises any missing permissions in the report as an error.
+func (r *PreflightReport) err() error {
+	if len(r.Missing) == 0 {
+		return nil
+	}
+
+	missing := make([]string, len(r.Missing))
+	for i, mp := range r.Missing {
+		missing[i] = mp.String()
+	}
+
+	return fmt.Errorf("missing permissions on [%v]: %s", r.SecretName, strings.Join(missing, "; "))
+}
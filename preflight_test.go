@@ -0,0 +1,220 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"testing"
+
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var allPermissions = []string{
+	"secretmanager.versions.access",
+	"secretmanager.versions.list",
+	"secretmanager.versions.add",
+	"secretmanager.versions.destroy",
+	"secretmanager.secrets.delete",
+}
+
+func TestPreflight_invalidConfig(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "My_Project", DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.EqualError(t, err, "invalid smcache config: ProjectID [My_Project] is not a valid GCP project ID")
+	assert.Nil(t, report)
+}
+
+func TestPreflight_happyPath(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, status.Error(codes.AlreadyExists, "exists"))
+	m.EXPECT().TestIamPermissions(gomock.Eq(&iampb.TestIamPermissionsRequest{
+		Resource:    "projects/my-project/secrets/test-smcache-preflight",
+		Permissions: allPermissions,
+	})).Return(&iampb.TestIamPermissionsResponse{Permissions: allPermissions}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "my-project", SecretPrefix: "test-", DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, allPermissions, report.Granted)
+	assert.Empty(t, report.Missing)
+}
+
+func TestPreflight_keepOldCertificates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Without version cleanup, destroy permission isn't needed.
+	permissions := []string{
+		"secretmanager.versions.access",
+		"secretmanager.versions.list",
+		"secretmanager.versions.add",
+		"secretmanager.secrets.delete",
+	}
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, nil)
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/my-project/secrets/smcache-preflight",
+	})).Return(nil)
+	m.EXPECT().TestIamPermissions(gomock.Eq(&iampb.TestIamPermissionsRequest{
+		Resource:    "projects/my-project/secrets/smcache-preflight",
+		Permissions: permissions,
+	})).Return(&iampb.TestIamPermissionsResponse{Permissions: permissions}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "my-project", KeepOldCertificates: true, DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.Nil(t, err)
+	assert.Empty(t, report.Missing)
+}
+
+func TestPreflight_missingRoles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, nil)
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/my-project/secrets/smcache-preflight",
+	})).Return(nil)
+	m.EXPECT().TestIamPermissions(gomock.Any()).Return(
+		&iampb.TestIamPermissionsResponse{Permissions: []string{"secretmanager.versions.access"}}, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "my-project", KeepOldCertificates: true, DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.EqualError(t, err, "missing permissions on [projects/my-project/secrets/smcache-preflight]: "+
+		"secretmanager.versions.list (needed by Put, granted by roles/secretmanager.viewer); "+
+		"secretmanager.versions.add (needed by Put, granted by roles/secretmanager.secretVersionAdder); "+
+		"secretmanager.secrets.delete (needed by Delete, granted by roles/secretmanager.admin)")
+	assert.Equal(t, []string{"secretmanager.versions.access"}, report.Granted)
+	assert.Len(t, report.Missing, 3)
+}
+
+func TestPreflight_probeLeft(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, nil)
+	m.EXPECT().TestIamPermissions(gomock.Any()).Return(&iampb.TestIamPermissionsResponse{Permissions: allPermissions}, nil)
+	m.EXPECT().DeleteSecret(gomock.Any()).Return(status.Error(codes.PermissionDenied, "denied"))
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "my-project", DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, report.ProbeLeft)
+}
+
+func TestPreflight_createDenied(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, status.Error(codes.PermissionDenied, "denied"))
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "my-project", DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.EqualError(t, err, "missing permissions on [projects/my-project/secrets/smcache-preflight]: "+
+		"secretmanager.secrets.create (needed by Put, granted by roles/secretmanager.admin)")
+	assert.Equal(t, []MissingPermission{{
+		Permission: "secretmanager.secrets.create",
+		Operation:  "Put",
+		Role:       "roles/secretmanager.admin",
+	}}, report.Missing)
+}
+
+func TestPreflight_projectUnreachable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, status.Error(codes.NotFound, "no such project"))
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "my-project", DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.EqualError(t, err, "project [my-project] is not reachable: "+
+		"failed to create Secret. rpc error: code = NotFound desc = no such project")
+	assert.Nil(t, report)
+}
+
+func TestPreflight_clientError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+
+	cache := newCacheWithErrorMockGrpc(Config{ProjectID: "my-project", DebugLogging: debug}, m)
+	report, err := cache.Preflight(context.Background())
+
+	assert.EqualError(t, err, "failed to setup client: problem creating client")
+	assert.Nil(t, report)
+}
+
+func TestPreflight_deleteMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		delete []string
+	}{
+		{"secret", Config{}, []string{"secretmanager.versions.destroy", "secretmanager.secrets.delete"}},
+		{"destroy", Config{DeleteMode: DeleteModeDestroyVersions}, []string{"secretmanager.versions.destroy"}},
+		{"destroyKeepOld", Config{DeleteMode: DeleteModeDestroyVersions, KeepOldCertificates: true},
+			[]string{"secretmanager.versions.destroy"}},
+		{"disable", Config{DeleteMode: DeleteModeDisableVersions},
+			[]string{"secretmanager.versions.destroy", "secretmanager.versions.disable"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var permissions []string
+			for _, c := range tt.config.requiredPermissions() {
+				permissions = append(permissions, c.permission)
+			}
+
+			want := append([]string{
+				"secretmanager.versions.access",
+				"secretmanager.versions.list",
+				"secretmanager.versions.add",
+			}, tt.delete...)
+			assert.Equal(t, want, permissions)
+		})
+	}
+}
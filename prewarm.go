@@ -0,0 +1,212 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/api/iterator"
+)
+
+// defaultPrewarmConcurrency is used when PrewarmOptions.Concurrency is not set.
+const defaultPrewarmConcurrency = 8
+
+// PrewarmOptions controls which certificates Prewarm loads, and how.
+type PrewarmOptions struct {
+	// Concurrency is how many certificates are loaded at once.
+	// Optional, defaults to 8.
+	Concurrency int
+
+	// ListOptions narrows down the certificates loaded. Optional.
+	ListOptions *ListOptions
+}
+
+// Prewarm loads the certificates stored under SecretPrefix into manager, so the
+// first handshake for each domain doesn't wait on Secret Manager. Call it before
+// the server starts accepting connections. manager.Cache must be this SMCache.
+//
+// Each certificate is read, and if it has not expired, handed to autocert by
+// calling manager.GetCertificate with a ClientHello for its domain (an RSA one
+// for "+rsa" keys). Expired and unreadable certificates are skipped, so Prewarm
+// never makes autocert issue a certificate. Loaded certificates are renewed by
+// autocert as usual.
+//
+// The keys of the loaded certificates are returned. Prewarm carries on past
+// certificates it could not load, and returns an error describing them at the end.
+func (smc *SMCache) Prewarm(ctx context.Context, manager *autocert.Manager, opts *PrewarmOptions) ([]string, error) {
+	return prewarm(ctx, manager, opts, smc.Entries, smc.Get, smc.logf)
+}
+
+// Prewarm loads the certificates of every shard into manager. manager.Cache must
+// be this Router. See SMCache.Prewarm.
+func (r *Router) Prewarm(ctx context.Context, manager *autocert.Manager, opts *PrewarmOptions) ([]string, error) {
+	return prewarm(ctx, manager, opts, r.Entries, r.Get, r.shards[0].logf)
+}
+
+func prewarm(ctx context.Context, manager *autocert.Manager, opts *PrewarmOptions,
+	entries func(context.Context, *ListOptions) *EntryIterator,
+	get func(context.Context, string) ([]byte, error),
+	logf func(string, ...interface{}),
+) ([]string, error) {
+	var o PrewarmOptions
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultPrewarmConcurrency
+	}
+
+	var (
+		mu       sync.Mutex
+		loaded   []string
+		failures []string
+		wg       sync.WaitGroup
+	)
+
+	slots := make(chan struct{}, o.Concurrency)
+
+	load := func(key string) {
+		defer func() { <-slots }()
+		defer wg.Done()
+
+		ok, err := prewarmKey(ctx, manager, get, key)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%v: %v", key, err))
+		case ok:
+			loaded = append(loaded, key)
+		default:
+			logf("Prewarm skipping expired certificate [%v]", key)
+		}
+	}
+
+	it := entries(ctx, o.ListOptions)
+	defer it.Stop()
+
+	var listErr error
+
+	for {
+		e, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			listErr = err
+			break
+		}
+
+		if !e.Exact || prewarmHello(e.Key) == nil {
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			listErr = ctx.Err()
+		}
+
+		if listErr != nil {
+			break
+		}
+
+		wg.Add(1)
+
+		go load(e.Key)
+	}
+
+	wg.Wait()
+	sort.Strings(loaded)
+
+	if listErr != nil {
+		return loaded, fmt.Errorf("failed to prewarm certificates. %w", listErr)
+	}
+
+	if len(failures) > 0 {
+		return loaded, fmt.Errorf("failed to prewarm %d certificates: %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	return loaded, nil
+}
+
+// prewarmKey loads the certificate stored at key into manager. It returns false
+// without loading it if the certificate has expired.
+func prewarmKey(ctx context.Context, manager *autocert.Manager,
+	get func(context.Context, string) ([]byte, error), key string,
+) (bool, error) {
+	data, err := get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	// autocert treats an expired certificate as missing, and would issue a new one.
+	notAfter, err := certNotAfter(data)
+	if err != nil {
+		return false, err
+	}
+
+	if !time.Now().Before(notAfter) {
+		return false, nil
+	}
+
+	if _, err := manager.GetCertificate(prewarmHello(key)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// prewarmHello returns a ClientHello that makes autocert load the certificate
+// stored at key, or nil if key is not a certificate autocert serves.
+func prewarmHello(key string) *tls.ClientHelloInfo {
+	if key == accountKey || strings.HasSuffix(key, tokenSuffix) || strings.HasSuffix(key, httpTokenSuffix) {
+		return nil
+	}
+
+	domain := keyDomain(key)
+	if !strings.Contains(domain, ".") {
+		// autocert rejects server names without a dot.
+		return nil
+	}
+
+	if strings.HasSuffix(key, rsaSuffix) {
+		return &tls.ClientHelloInfo{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.PSSWithSHA256},
+			SupportedCurves:  []tls.CurveID{tls.X25519},
+		}
+	}
+
+	return &tls.ClientHelloInfo{
+		ServerName:       domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+func TestPrewarm(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := time.Now().Add(60 * 24 * time.Hour)
+	certs := map[string][]byte{
+		"projects/projId/secrets/example_com/versions/latest":     testDomainCertPEM(t, ecKey, "example.com", valid),
+		"projects/projId/secrets/example_com_rsa/versions/latest": testDomainCertPEM(t, rsaKey, "example.com", valid),
+		"projects/projId/secrets/old_example/versions/latest":     testDomainCertPEM(t, ecKey, "old.example", time.Now().Add(-time.Hour)),
+	}
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		managedSecret("projects/projId/secrets/example_com"),
+		managedSecret("projects/projId/secrets/example_com_rsa"),
+		managedSecret("projects/projId/secrets/example_com_token"),
+		managedSecret("projects/projId/secrets/old_example"),
+		managedSecret("projects/projId/secrets/acme_account_key"),
+		managedSecret("projects/projId/secrets/abc_http-01"),
+	}})
+	// Each certificate is read once by Prewarm, and once more by autocert.
+	m.EXPECT().AccessSecretVersion(gomock.Any()).DoAndReturn(
+		func(req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+			return &secretmanagerpb.AccessSecretVersionResponse{Payload: checksummed(certs[req.GetName()])}, nil
+		}).Times(5)
+	m.EXPECT().Close().Times(6)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	manager := &autocert.Manager{Prompt: autocert.AcceptTOS, Cache: cache, HostPolicy: autocert.HostWhitelist()}
+
+	keys, err := cache.Prewarm(context.Background(), manager, &PrewarmOptions{Concurrency: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"example.com", "example.com+rsa"}, keys)
+
+	// Both certificates are now served by autocert without reading the cache.
+	cert, err := manager.GetCertificate(prewarmHello("example.com"))
+	assert.Nil(t, err)
+	assert.IsType(t, &ecdsa.PrivateKey{}, cert.PrivateKey)
+
+	cert, err = manager.GetCertificate(prewarmHello("example.com+rsa"))
+	assert.Nil(t, err)
+	assert.IsType(t, &rsa.PrivateKey{}, cert.PrivateKey)
+}
+
+func TestPrewarm_errors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		managedSecret("projects/projId/secrets/example_com"),
+	}})
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{Payload: checksummed([]byte("not a certificate"))}, nil)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	manager := &autocert.Manager{Prompt: autocert.AcceptTOS, Cache: cache, HostPolicy: autocert.HostWhitelist()}
+
+	keys, err := cache.Prewarm(context.Background(), manager, nil)
+	assert.Empty(t, keys)
+	assert.EqualError(t, err, "failed to prewarm 1 certificates: example.com: no certificate found")
+}
+
+func TestPrewarm_listError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&sliErrorSecrets{})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+
+	_, err := cache.Prewarm(context.Background(), &autocert.Manager{Cache: cache}, nil)
+	assert.EqualError(t, err, "failed to prewarm certificates. failed to list secrets. rpc error: code = PermissionDenied desc = denied")
+}
+
+func TestPrewarmHello(t *testing.T) {
+	for _, key := range []string{"acme_account+key", "example.com+token", "abc+http-01", "localhost"} {
+		assert.Nil(t, prewarmHello(key), key)
+	}
+
+	assert.Equal(t, "example.com", prewarmHello("example.com").ServerName)
+	assert.Equal(t, "example.com", prewarmHello("example.com+rsa").ServerName)
+}
+
+// testDomainCertPEM returns key and a self-signed certificate for domain that
+// expires at notAfter, PEM encoded the way autocert stores them.
+func testDomainCertPEM(t *testing.T, key crypto.Signer, domain string, notAfter time.Time) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return buf.Bytes()
+}
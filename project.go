@@ -0,0 +1,142 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
+)
+
+// How long to wait on the metadata server before giving up on it.
+const metadataTimeout = 5 * time.Second
+
+// projectIDSource is somewhere the ProjectID can be detected from.
+type projectIDSource struct {
+	name string
+	find func(ctx context.Context) (string, error)
+}
+
+// projectIDSources are tried in order until one of them finds a ProjectID.
+var projectIDSources = []projectIDSource{
+	{"application default credentials", adcProjectID},
+	{"metadata server", metadataProjectID},
+	{"GOOGLE_CLOUD_PROJECT", envProjectID},
+}
+
+// findDefaultCredentials is replaced in tests.
+var findDefaultCredentials = google.FindDefaultCredentials
+
+func adcProjectID(ctx context.Context) (string, error) {
+	creds, err := findDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return "", err
+	}
+
+	return creds.ProjectID, nil
+}
+
+// metadataProjectID asks the GCE/Cloud Run metadata server. If GCE_METADATA_HOST
+// is set, that host is used instead of the real metadata server.
+func metadataProjectID(ctx context.Context) (string, error) {
+	if os.Getenv("GCE_METADATA_HOST") == "" && !metadata.OnGCE() {
+		return "", errors.New("not running on GCE")
+	}
+
+	id, err := metadata.NewClient(&http.Client{Timeout: metadataTimeout}).Get("project/project-id")
+
+	return strings.TrimSpace(id), err
+}
+
+func envProjectID(ctx context.Context) (string, error) {
+	return os.Getenv("GOOGLE_CLOUD_PROJECT"), nil
+}
+
+// detectProjectID tries each of the projectIDSources, and returns the first
+// ProjectID found along with the name of the source it came from.
+func detectProjectID(ctx context.Context) (id, source string, err error) {
+	var problems []string
+
+	for _, s := range projectIDSources {
+		id, err := s.find(ctx)
+		if err == nil && id != "" {
+			return id, s.name, nil
+		}
+
+		if err == nil {
+			err = errors.New("not set")
+		}
+
+		problems = append(problems, fmt.Sprintf("%s: %v", s.name, err))
+	}
+
+	return "", "", errors.New(strings.Join(problems, "; "))
+}
+
+// projectRetryDelay is how long a failure to detect the ProjectID is returned
+// to every caller, before detection is tried again.
+const projectRetryDelay = 30 * time.Second
+
+// resolveProjectID detects the ProjectID if the Config did not set one.
+// It must be called before projectID is used by any operation.
+func (smc *SMCache) resolveProjectID(ctx context.Context) error {
+	// Other Backends treat secret names as opaque, so they work without one.
+	if smc.projectID() != "" || smc.Backend != nil {
+		return nil
+	}
+
+	smc.projectMu.Lock()
+	defer smc.projectMu.Unlock()
+
+	if smc.projectID() != "" {
+		return nil
+	}
+
+	if smc.projectErr != nil && time.Since(smc.projectErrAt) < projectRetryDelay {
+		return smc.projectErr
+	}
+
+	id, source, err := detectProjectID(ctx)
+	if err != nil {
+		smc.projectErr = fmt.Errorf("ProjectID is not set, and could not be detected. %w", err)
+		smc.projectErrAt = time.Now()
+
+		return smc.projectErr
+	}
+
+	smc.logf("Detected ProjectID [%v] from %v", id, source)
+	smc.detectedProjectID.Store(id)
+	smc.projectErr = nil
+
+	return nil
+}
+
+// projectID is Config.ProjectID, or the one resolveProjectID detected.
+func (smc *SMCache) projectID() string {
+	if smc.ProjectID != "" {
+		return smc.ProjectID
+	}
+
+	id, _ := smc.detectedProjectID.Load().(string)
+
+	return id
+}
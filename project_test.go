@@ -0,0 +1,222 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2/google"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeADC replaces the application default credentials lookup for a test.
+func fakeADC(t *testing.T, projectID string, err error) {
+	orig := findDefaultCredentials
+	findDefaultCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		if err != nil {
+			return nil, err
+		}
+
+		return &google.Credentials{ProjectID: projectID}, nil
+	}
+
+	t.Cleanup(func() { findDefaultCredentials = orig })
+}
+
+// fakeMetadataServer serves projectID as the metadata server would, and points
+// GCE_METADATA_HOST at it. An empty projectID responds with NotFound.
+func fakeMetadataServer(t *testing.T, projectID string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/project/project-id" ||
+			projectID == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fmt.Fprint(w, projectID)
+	}))
+
+	t.Cleanup(srv.Close)
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+}
+
+func TestDetectProjectID_adc(t *testing.T) {
+	fakeADC(t, "adc-project", nil)
+	fakeMetadataServer(t, "metadata-project")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-project")
+
+	id, source, err := detectProjectID(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "adc-project", id)
+	assert.Equal(t, "application default credentials", source)
+}
+
+func TestDetectProjectID_metadata(t *testing.T) {
+	fakeADC(t, "", nil)
+	fakeMetadataServer(t, "metadata-project")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-project")
+
+	id, source, err := detectProjectID(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "metadata-project", id)
+	assert.Equal(t, "metadata server", source)
+}
+
+func TestDetectProjectID_env(t *testing.T) {
+	fakeADC(t, "", fmt.Errorf("no credentials"))
+	fakeMetadataServer(t, "")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-project")
+
+	id, source, err := detectProjectID(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "env-project", id)
+	assert.Equal(t, "GOOGLE_CLOUD_PROJECT", source)
+}
+
+func TestDetectProjectID_notFound(t *testing.T) {
+	fakeADC(t, "", fmt.Errorf("no credentials"))
+	fakeMetadataServer(t, "")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+
+	id, _, err := detectProjectID(context.Background())
+
+	assert.Equal(t, "", id)
+	assert.Contains(t, err.Error(), "application default credentials: no credentials; metadata server: ")
+	assert.Contains(t, err.Error(), "; GOOGLE_CLOUD_PROJECT: not set")
+}
+
+func TestGet_detectedProjectID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fakeADC(t, "adc-project", nil)
+
+	secret := []byte("secret data!")
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Eq(
+		&secretmanagerpb.AccessSecretVersionRequest{
+			Name: "projects/adc-project/secrets/d/versions/latest",
+		})).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{
+			Name:    "d",
+			Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		}, nil).Times(2)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{DebugLogging: debug}, m)
+
+	result, err := cache.Get(context.Background(), "d")
+	assert.Nil(t, err)
+	assert.Equal(t, result, secret)
+	assert.Equal(t, "adc-project", cache.projectID())
+	assert.Empty(t, cache.ProjectID)
+
+	// Detection only happens once.
+	fakeADC(t, "other-project", nil)
+	_, err = cache.Get(context.Background(), "d")
+	assert.Nil(t, err)
+}
+
+func TestGet_undetectableProjectID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fakeADC(t, "", fmt.Errorf("no credentials"))
+	fakeMetadataServer(t, "")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+
+	m := apimocks.NewMockSecretClient(ctrl)
+
+	cache := newCacheWithMockGrpc(Config{DebugLogging: debug}, m)
+	result, err := cache.Get(context.Background(), "d")
+
+	assert.Contains(t, err.Error(), "ProjectID is not set, and could not be detected.")
+	assert.Nil(t, result)
+}
+
+func TestResolveProjectID_failureCached(t *testing.T) {
+	calls := 0
+	orig := findDefaultCredentials
+	findDefaultCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		calls++
+		return nil, fmt.Errorf("no credentials")
+	}
+	t.Cleanup(func() { findDefaultCredentials = orig })
+
+	fakeMetadataServer(t, "")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+
+	cache := NewSMCache(Config{DebugLogging: debug})
+	err := cache.resolveProjectID(context.Background())
+	assert.Contains(t, err.Error(), "ProjectID is not set, and could not be detected.")
+
+	// Until projectRetryDelay passes, the failure is returned without detecting again.
+	assert.Equal(t, err, cache.resolveProjectID(context.Background()))
+	assert.Equal(t, 1, calls)
+
+	cache.projectErrAt = time.Now().Add(-projectRetryDelay)
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-project")
+	assert.Nil(t, cache.resolveProjectID(context.Background()))
+	assert.Equal(t, "env-project", cache.projectID())
+}
+
+func TestResolveProjectID_concurrentWriteBehind(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fakeADC(t, "adc-project", nil)
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, status.Error(codes.NotFound, "not found")).AnyTimes()
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}).AnyTimes()
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(&secretmanagerpb.SecretVersion{}, nil).AnyTimes()
+	m.EXPECT().Close().AnyTimes()
+
+	cache := newCacheWithMockGrpc(Config{WriteBehind: true, DebugLogging: debug}, m)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			_, _ = cache.Get(context.Background(), "other.example")
+		}()
+
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, cache.Put(context.Background(), "example.com", []byte("cert")))
+		}()
+	}
+
+	wg.Wait()
+	assert.Nil(t, cache.Flush(context.Background()))
+	assert.Equal(t, "adc-project", cache.projectID())
+}
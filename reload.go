@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Reloader serves TLS through an autocert.Manager that it can replace. autocert
+// keeps every certificate it has loaded in memory, and only reads its Cache again
+// when that copy nears expiry, so a certificate renewed by another replica is
+// only served once the Manager is replaced. Call Reload for that, for example
+// from a Watch or Subscribe callback.
+//
+// Use the Reloader's GetCertificate, TLSConfig and HTTPHandler in place of the
+// Manager's.
+type Reloader struct {
+	newManager func() *autocert.Manager
+
+	// mu serialises Reload and HTTPHandler, and guards httpFallback and useHTTP.
+	mu           sync.Mutex
+	httpFallback http.Handler
+	useHTTP      bool
+
+	current atomic.Pointer[reloaderState]
+}
+
+// reloaderState is one Manager, with its HTTPHandler if one was asked for.
+type reloaderState struct {
+	manager *autocert.Manager
+	handler http.Handler
+}
+
+// NewReloader returns a Reloader serving from newManager(). newManager is called
+// again by every Reload, and must return a new Manager each time, normally with
+// the same Cache, Prompt, HostPolicy and Email.
+func NewReloader(newManager func() *autocert.Manager) *Reloader {
+	r := &Reloader{newManager: newManager}
+	r.swap(newManager())
+
+	return r
+}
+
+// Manager returns the Manager currently serving.
+func (r *Reloader) Manager() *autocert.Manager {
+	return r.current.Load().manager
+}
+
+// Reload replaces the Manager with a new one, which reads each certificate from
+// its Cache again on the next handshake for the domain (see Prewarm to do that
+// up front). Issuance or renewal in progress in the old Manager carries on, and
+// stores its result in the Cache.
+//
+// autocert has no way to stop the old Manager's renewal timers. When one fires,
+// the old Manager finds the renewed certificate in the Cache and does nothing more.
+func (r *Reloader) Reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.swap(r.newManager())
+}
+
+// swap makes m the Manager serving. r.mu must be held, except by NewReloader.
+func (r *Reloader) swap(m *autocert.Manager) {
+	s := &reloaderState{manager: m}
+	if r.useHTTP {
+		s.handler = m.HTTPHandler(r.httpFallback)
+	}
+
+	r.current.Store(s)
+}
+
+// GetCertificate calls GetCertificate of the current Manager.
+func (r *Reloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Manager().GetCertificate(hello)
+}
+
+// TLSConfig is autocert.Manager.TLSConfig, getting certificates from the current Manager.
+func (r *Reloader) TLSConfig() *tls.Config {
+	cfg := r.Manager().TLSConfig()
+	cfg.GetCertificate = r.GetCertificate
+
+	return cfg
+}
+
+// HTTPHandler is autocert.Manager.HTTPHandler, answering http-01 challenges
+// with the current Manager. Only call it once.
+func (r *Reloader) HTTPHandler(fallback http.Handler) http.Handler {
+	r.mu.Lock()
+	r.httpFallback = fallback
+	r.useHTTP = true
+	r.swap(r.Manager())
+	r.mu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestReloader(t *testing.T) {
+	cache := NewSMCache(Config{Backend: NewMemoryBackend(), DebugLogging: debug})
+	ctx := context.Background()
+
+	newCert := func() []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return testDomainCertPEM(t, key, "example.com", time.Now().Add(60*24*time.Hour))
+	}
+
+	assert.Nil(t, cache.Put(ctx, "example.com", newCert()))
+
+	managers := 0
+	r := NewReloader(func() *autocert.Manager {
+		managers++
+		return &autocert.Manager{Prompt: autocert.AcceptTOS, Cache: cache, HostPolicy: autocert.HostWhitelist()}
+	})
+
+	first, err := r.GetCertificate(prewarmHello("example.com"))
+	assert.Nil(t, err)
+
+	// Another replica renews the certificate. autocert keeps serving its copy until reloaded.
+	assert.Nil(t, cache.Put(ctx, "example.com", newCert()))
+
+	cert, err := r.TLSConfig().GetCertificate(prewarmHello("example.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, first.Certificate, cert.Certificate)
+
+	r.Reload()
+
+	cert, err = r.GetCertificate(prewarmHello("example.com"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Certificate, cert.Certificate)
+	assert.Equal(t, 2, managers)
+}
+
+func TestReloader_HTTPHandler(t *testing.T) {
+	cache := NewSMCache(Config{Backend: NewMemoryBackend(), DebugLogging: debug})
+	r := NewReloader(func() *autocert.Manager {
+		return &autocert.Manager{Prompt: autocert.AcceptTOS, Cache: cache}
+	})
+
+	h := r.HTTPHandler(nil)
+	r.Reload()
+
+	assert.Nil(t, cache.Put(context.Background(), "tok+http-01", []byte("tok.thumbprint")))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/.well-known/acme-challenge/tok", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "tok.thumbprint", rec.Body.String())
+}
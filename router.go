@@ -0,0 +1,263 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var _ autocert.Cache = (*Router)(nil)
+
+// RouteFunc picks which shard stores the keys of a domain. It returns an
+// index into the shards passed to NewRouter, and must always return the
+// same shard for the same domain.
+//
+// The ACME account key is routed as the domain "acme_account+key", and
+// http-01 challenge tokens as "<token>+http-01".
+type RouteFunc func(domain string) int
+
+// Router implements autocert.Cache by spreading keys across several shards,
+// each an SMCache with its own ProjectID and SecretPrefix. This keeps each
+// project under Secret Manager's per-project quotas, and lets IAM be split
+// between groups of domains.
+//
+// All keys for a domain (such as its ECDSA and RSA certificates) are stored
+// in the same shard.
+type Router struct {
+	shards []*SMCache
+	route  RouteFunc
+	hash   RouteFunc
+}
+
+// NewRouter creates a Router over one shard per Config. route picks the shard
+// for each domain. If route is nil, HashRoute(len(shards)) is used.
+func NewRouter(shards []Config, route RouteFunc) (*Router, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("at least one shard is required")
+	}
+
+	r := &Router{route: route, hash: HashRoute(len(shards))}
+	if route == nil {
+		r.route = r.hash
+	}
+
+	for i, c := range shards {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+
+		r.shards = append(r.shards, NewSMCache(c))
+	}
+
+	return r, nil
+}
+
+// Shards returns the SMCache of each shard, in the order their Configs were given.
+func (r *Router) Shards() []*SMCache {
+	return append([]*SMCache(nil), r.shards...)
+}
+
+// Shard returns the SMCache that stores key.
+func (r *Router) Shard(key string) (*SMCache, error) {
+	domain := keyDomain(key)
+
+	i := r.route(domain)
+	if i == unrouted {
+		i = r.hash(domain)
+	}
+
+	if i < 0 || i >= len(r.shards) {
+		return nil, fmt.Errorf("route for [%v] picked shard %d, but there are %d shards", domain, i, len(r.shards))
+	}
+
+	return r.shards[i], nil
+}
+
+// Get returns a certificate data for the specified key from the shard that stores it.
+// If there's no such key, Get returns ErrCacheMiss.
+func (r *Router) Get(ctx context.Context, key string) ([]byte, error) {
+	shard, err := r.Shard(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return shard.Get(ctx, key)
+}
+
+// Put stores the data under the specified key, in the shard picked for it.
+func (r *Router) Put(ctx context.Context, key string, data []byte) error {
+	shard, err := r.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return shard.Put(ctx, key, data)
+}
+
+// Delete removes a certificate data from the shard that stores the specified key.
+// If there's no such key in the cache, Delete returns nil.
+func (r *Router) Delete(ctx context.Context, key string) error {
+	shard, err := r.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return shard.Delete(ctx, key)
+}
+
+// Watch watches key in the shard that stores it. See SMCache.Watch.
+func (r *Router) Watch(ctx context.Context, key string, fn func(data []byte)) error {
+	shard, err := r.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return shard.Watch(ctx, key, fn)
+}
+
+// Entries lists the secrets of every shard, one shard after another.
+// Shards that share a project and prefix are listed more than once. See SMCache.Entries.
+func (r *Router) Entries(ctx context.Context, opts *ListOptions) *EntryIterator {
+	return newEntryIterator(ctx, opts, r.shards)
+}
+
+// Keys lists the autocert keys of every shard. See Router.Entries.
+func (r *Router) Keys(ctx context.Context, opts *ListOptions) *KeyIterator {
+	return &KeyIterator{entries: r.Entries(ctx, opts)}
+}
+
+// Evict removes keys from the in-memory caches of every shard. See SMCache.Evict.
+func (r *Router) Evict(keys ...string) {
+	for _, s := range r.shards {
+		s.Evict(keys...)
+	}
+}
+
+// Flush flushes every shard, see SMCache.Flush.
+func (r *Router) Flush(ctx context.Context) error {
+	var failures []string
+
+	for i, s := range r.shards {
+		if err := s.Flush(ctx); err != nil {
+			failures = append(failures, fmt.Sprintf("shard %d: %v", i, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to flush %d shards: %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// Close stops the write-behind worker of every shard. See SMCache.Close.
+func (r *Router) Close() error {
+	for _, s := range r.shards {
+		s.Close()
+	}
+
+	return nil
+}
+
+// Stats adds up the Stats of every shard. MaxStaleness and Staleness are the
+// largest of any shard.
+func (r *Router) Stats() Stats {
+	var total Stats
+
+	for _, s := range r.shards {
+		st := s.Stats()
+		total.StaleEntries += st.StaleEntries
+		total.StaleServed += st.StaleServed
+		total.Refreshes += st.Refreshes
+		total.RefreshErrors += st.RefreshErrors
+		total.TokenEntries += st.TokenEntries
+		total.MissEntries += st.MissEntries
+		total.PendingWrites += st.PendingWrites
+
+		if st.MaxStaleness > total.MaxStaleness {
+			total.MaxStaleness = st.MaxStaleness
+		}
+
+		if st.Staleness > total.Staleness {
+			total.Staleness = st.Staleness
+		}
+	}
+
+	return total
+}
+
+// HashRoute spreads domains across n shards with a consistent hash.
+// Growing n moves as few domains as possible (about 1/n of them) to new shards.
+func HashRoute(n int) RouteFunc {
+	return func(domain string) int {
+		h := fnv.New64a()
+		h.Write([]byte(strings.ToLower(domain)))
+
+		return jumpHash(h.Sum64(), n)
+	}
+}
+
+// SuffixRoute routes domains by their suffix. suffixes maps a domain suffix,
+// such as "example.com", to a shard. It matches that domain and any subdomain
+// of it, and the longest matching suffix wins. Domains that match no suffix
+// are routed by fallback. If fallback is nil, a Router spreads them across all
+// of its shards with HashRoute.
+func SuffixRoute(suffixes map[string]int, fallback RouteFunc) RouteFunc {
+	if fallback == nil {
+		fallback = func(string) int { return unrouted }
+	}
+
+	return func(domain string) int {
+		domain = strings.ToLower(domain)
+		best, shard := -1, 0
+
+		for suffix, i := range suffixes {
+			suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+			if (domain == suffix || strings.HasSuffix(domain, "."+suffix)) && len(suffix) > best {
+				best, shard = len(suffix), i
+			}
+		}
+
+		if best < 0 {
+			return fallback(domain)
+		}
+
+		return shard
+	}
+}
+
+// unrouted is returned by routes that leave a domain to the Router's HashRoute.
+const unrouted = math.MinInt
+
+// jumpHash is the "Jump Consistent Hash" of Lamping and Veach,
+// https://arxiv.org/abs/1406.2294.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
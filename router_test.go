@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+func TestRouter_suffixRoute(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("secret data!")
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Eq(
+		&secretmanagerpb.AccessSecretVersionRequest{
+			Name: "projects/customers-b/secrets/b-www_example_com_rsa/versions/latest",
+		})).Return(
+		&secretmanagerpb.AccessSecretVersionResponse{
+			Payload: &secretmanagerpb.SecretPayload{Data: secret},
+		}, nil)
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  "projects/customers-a/secrets/a-other_org",
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{})
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/customers-b/secrets/b-example_com",
+	})).Return(nil)
+	m.EXPECT().Close().Times(3)
+
+	r, err := NewRouter([]Config{
+		{ProjectID: "customers-a", SecretPrefix: "a-", DebugLogging: debug},
+		{ProjectID: "customers-b", SecretPrefix: "b-", DebugLogging: debug},
+	}, SuffixRoute(map[string]int{"example.com": 1}, func(string) int { return 0 }))
+	assert.Nil(t, err)
+	withMockShards(r, m)
+
+	result, err := r.Get(context.Background(), "www.example.com+rsa")
+	assert.Nil(t, err)
+	assert.Equal(t, secret, result)
+
+	assert.Nil(t, r.Put(context.Background(), "other.org", secret))
+	assert.Nil(t, r.Delete(context.Background(), "example.com"))
+}
+
+func TestRouter_badRoute(t *testing.T) {
+	r, err := NewRouter([]Config{{ProjectID: "my-project"}}, func(string) int { return 1 })
+	assert.Nil(t, err)
+
+	_, err = r.Get(context.Background(), "example.com")
+	assert.EqualError(t, err, "route for [example.com] picked shard 1, but there are 1 shards")
+	assert.EqualError(t, r.Put(context.Background(), "example.com", nil), err.Error())
+	assert.EqualError(t, r.Delete(context.Background(), "example.com"), err.Error())
+}
+
+func TestNewRouter_errors(t *testing.T) {
+	_, err := NewRouter(nil, nil)
+	assert.EqualError(t, err, "at least one shard is required")
+
+	_, err = NewRouter([]Config{{ProjectID: "my-project"}, {ProjectID: "Bad_Project"}}, nil)
+	assert.EqualError(t, err, "shard 1: invalid smcache config: ProjectID [Bad_Project] is not a valid GCP project ID")
+}
+
+func TestRouter_sameShardForDomain(t *testing.T) {
+	r, err := NewRouter([]Config{{ProjectID: "project-zero"}, {ProjectID: "project-one"}, {ProjectID: "project-two"}}, nil)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		domain := fmt.Sprintf("d%d.example.com", i)
+		want, _ := r.Shard(domain)
+
+		for _, key := range []string{domain + "+rsa", domain + "+token"} {
+			got, err := r.Shard(key)
+			assert.Nil(t, err)
+			assert.Same(t, want, got, key)
+		}
+	}
+}
+
+func TestHashRoute(t *testing.T) {
+	counts := make([]int, 4)
+	moved := 0
+
+	for i := 0; i < 4000; i++ {
+		domain := fmt.Sprintf("customer%d.example.com", i)
+		shard := HashRoute(4)(domain)
+		counts[shard]++
+
+		// Stable, and case insensitive like domain names.
+		assert.Equal(t, shard, HashRoute(4)(fmt.Sprintf("CUSTOMER%d.example.com", i)))
+
+		// Adding a shard should only move domains onto the new shard.
+		if grown := HashRoute(5)(domain); grown != shard {
+			assert.Equal(t, 4, grown)
+			moved++
+		}
+	}
+
+	for _, c := range counts {
+		assert.InDelta(t, 1000, c, 150)
+	}
+
+	assert.InDelta(t, 800, moved, 150)
+}
+
+func TestSuffixRoute(t *testing.T) {
+	route := SuffixRoute(map[string]int{
+		"example.com":        1,
+		"eu.example.com":     2,
+		".customer.test":     3,
+		"notexample.example": 4,
+	}, func(string) int { return 0 })
+
+	assert.Equal(t, 1, route("example.com"))
+	assert.Equal(t, 1, route("www.Example.com"))
+	assert.Equal(t, 2, route("eu.example.com"))
+	assert.Equal(t, 2, route("shop.eu.example.com"))
+	assert.Equal(t, 3, route("a.customer.test"))
+	assert.Equal(t, 0, route("badexample.com"))
+	assert.Equal(t, 0, route("acme_account+key"))
+}
+
+func TestSuffixRoute_nilFallback(t *testing.T) {
+	shards := []Config{{ProjectID: "shard-0"}, {ProjectID: "shard-1"}, {ProjectID: "shard-2"}}
+	r, err := NewRouter(shards, SuffixRoute(map[string]int{"example.com": 1}, nil))
+	assert.Nil(t, err)
+
+	shard, err := r.Shard("www.example.com+rsa")
+	assert.Nil(t, err)
+	assert.Equal(t, r.Shards()[1], shard)
+
+	for _, domain := range []string{"other.org", "example.net", "acme_account+key"} {
+		shard, err := r.Shard(domain)
+		assert.Nil(t, err)
+		assert.Equal(t, r.Shards()[HashRoute(len(shards))(domain)], shard, domain)
+	}
+}
+
+func TestKeyDomain(t *testing.T) {
+	assert.Equal(t, "example.com", keyDomain("example.com"))
+	assert.Equal(t, "example.com", keyDomain("example.com+rsa"))
+	assert.Equal(t, "example.com", keyDomain("example.com+token"))
+	assert.Equal(t, "abc123+http-01", keyDomain("abc123+http-01"))
+	assert.Equal(t, "acme_account+key", keyDomain("acme_account+key"))
+}
+
+// withMockShards makes every shard of r use m.
+func withMockShards(r *Router, m *apimocks.MockSecretClient) {
+	for _, s := range r.shards {
+		s.cf = &mockSecretClientFactoryImpl{mock: m}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stats is a snapshot of an SMCache's in-memory state, for metrics.
+type Stats struct {
+	// MaxStaleness is Config.MaxStaleness.
+	MaxStaleness time.Duration `json:"maxStaleness"`
+
+	// StaleEntries is how many last good values are held for MaxStaleness.
+	StaleEntries int `json:"staleEntries"`
+
+	// Staleness is the age of the oldest value currently served in place of
+	// Secret Manager, or 0 if Secret Manager is answering for every key.
+	Staleness time.Duration `json:"staleness"`
+
+	// StaleServed counts Gets answered with a stale value.
+	StaleServed uint64 `json:"staleServed"`
+
+	// Refreshes counts background refreshes of stale values, and RefreshErrors
+	// those that failed.
+	Refreshes     uint64 `json:"refreshes"`
+	RefreshErrors uint64 `json:"refreshErrors"`
+
+	// TokenEntries is how many http-01 tokens are held for HTTPTokenMemoryCache.
+	TokenEntries int `json:"tokenEntries"`
+
+	// MissEntries is how many keys are remembered as missing for MissCacheTTL.
+	MissEntries int `json:"missEntries"`
+
+	// PendingWrites is how many Puts are queued by WriteBehind.
+	PendingWrites int `json:"pendingWrites"`
+}
+
+// Stats returns a snapshot of the cache's in-memory state.
+func (smc *SMCache) Stats() Stats {
+	s := smc.stale.stats()
+	s.MaxStaleness = smc.MaxStaleness
+	s.TokenEntries = smc.tokens.len()
+	s.MissEntries = smc.misses.len()
+
+	smc.queue.mu.Lock()
+	s.PendingWrites = len(smc.queue.pending)
+	smc.queue.mu.Unlock()
+
+	return s
+}
+
+// isTransient reports whether err is a Secret Manager failure that may go away
+// by itself, so serving a stale value beats failing.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveStale returns the last good value of key if it is at most MaxStaleness old.
+// If failing is true, it is only returned if Secret Manager failed for key since
+// then. Every stale value served starts a background refresh, unless one is running.
+func (smc *SMCache) serveStale(key string, failing bool) ([]byte, bool) {
+	if smc.MaxStaleness <= 0 {
+		return nil, false
+	}
+
+	data, refresh, ok := smc.stale.serve(key, smc.MaxStaleness, failing)
+	if !ok {
+		return nil, false
+	}
+
+	smc.logf("GET: serving stale value of [%v]", key)
+
+	if refresh {
+		go smc.refreshStale(key)
+	}
+
+	return data, true
+}
+
+// refreshStale reads key from Secret Manager again, which replaces its stale value
+// if it succeeds.
+func (smc *SMCache) refreshStale(key string) {
+	_, err, _ := smc.gets.Do(key, func() (interface{}, error) {
+		return smc.get(context.Background(), key)
+	})
+
+	smc.stale.refreshed(key, err)
+
+	if err != nil {
+		smc.logf("problem refreshing stale value of [%v]. %v", key, err)
+		smc.errs.add(OpGet, key, err)
+	}
+}
+
+// staleCache holds the last good value of each key, for Config.MaxStaleness.
+type staleCache struct {
+	mu      sync.Mutex
+	entries map[string]*staleEntry
+
+	served, refreshes, refreshErrors uint64
+}
+
+type staleEntry struct {
+	data    []byte
+	fetched time.Time
+
+	// failing is set once Secret Manager fails for the key, and cleared by put.
+	failing bool
+
+	// refreshing is set while a background refresh runs.
+	refreshing bool
+}
+
+// put records data as the latest good value of key.
+func (sc *staleCache) put(key string, data []byte) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.entries == nil {
+		sc.entries = map[string]*staleEntry{}
+	}
+
+	e, ok := sc.entries[key]
+	if !ok {
+		e = &staleEntry{}
+		sc.entries[key] = e
+	}
+
+	e.data = append([]byte(nil), data...)
+	e.fetched = time.Now()
+	e.failing = false
+}
+
+func (sc *staleCache) remove(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	delete(sc.entries, key)
+}
+
+// serve returns a copy of key's last good value if it is at most maxStaleness old,
+// marking key as failing. refresh is true if the caller should start a refresh.
+func (sc *staleCache) serve(key string, maxStaleness time.Duration, failing bool) (data []byte, refresh, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	e, found := sc.entries[key]
+	if !found || (failing && !e.failing) {
+		return nil, false, false
+	}
+
+	if time.Since(e.fetched) > maxStaleness {
+		// Too old to ever be served again.
+		delete(sc.entries, key)
+		return nil, false, false
+	}
+
+	e.failing = true
+	refresh = !e.refreshing
+	e.refreshing = true
+	sc.served++
+
+	if refresh {
+		sc.refreshes++
+	}
+
+	return append([]byte(nil), e.data...), refresh, true
+}
+
+// refreshed records the result of a background refresh of key.
+func (sc *staleCache) refreshed(key string, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err != nil {
+		sc.refreshErrors++
+	}
+
+	// Only transient errors keep the stale value in use, so the next Get
+	// reports any other problem.
+	if err != nil && !isTransient(err) {
+		delete(sc.entries, key)
+	} else if e, ok := sc.entries[key]; ok {
+		e.refreshing = false
+	}
+}
+
+func (sc *staleCache) stats() Stats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	s := Stats{
+		StaleEntries:  len(sc.entries),
+		StaleServed:   sc.served,
+		Refreshes:     sc.refreshes,
+		RefreshErrors: sc.refreshErrors,
+	}
+
+	for _, e := range sc.entries {
+		if age := time.Since(e.fetched); e.failing && age > s.Staleness {
+			s.Staleness = age
+		}
+	}
+
+	return s
+}
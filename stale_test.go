@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyBackend answers AccessSecretVersion with data, or err while err is set.
+type flakyBackend struct {
+	mu    sync.Mutex
+	data  []byte
+	err   error
+	calls int
+}
+
+func (f *flakyBackend) set(data []byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.data, f.err = data, err
+}
+
+func (f *flakyBackend) called() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls
+}
+
+func (f *flakyBackend) access(*secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &secretmanagerpb.AccessSecretVersionResponse{Name: "bd", Payload: checksummed(f.data)}, nil
+}
+
+func newFlakyCache(t *testing.T, config Config) (*SMCache, *flakyBackend) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	f := &flakyBackend{}
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).DoAndReturn(f.access).AnyTimes()
+	m.EXPECT().Close().AnyTimes()
+
+	config.ProjectID = "projId"
+	config.DebugLogging = debug
+
+	return newCacheWithMockGrpc(config, m), f
+}
+
+func TestGet_stale(t *testing.T) {
+	cache, f := newFlakyCache(t, Config{MaxStaleness: time.Minute})
+	ctx := context.Background()
+
+	f.set([]byte("v1"), nil)
+	data, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), data)
+
+	// Secret Manager is down: the last good value is served, and refreshed in the background.
+	f.set(nil, status.Error(codes.Unavailable, "unavailable"))
+	data, err = cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), data)
+	assert.Eventually(t, func() bool { return cache.Stats().RefreshErrors == 1 }, time.Second, time.Millisecond)
+
+	// While it stays down, Gets don't wait for it.
+	calls := f.called()
+	data, err = cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), data)
+	assert.Eventually(t, func() bool { return cache.Stats().RefreshErrors == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, calls+1, f.called())
+
+	stats := cache.Stats()
+	assert.Equal(t, time.Minute, stats.MaxStaleness)
+	assert.Equal(t, 1, stats.StaleEntries)
+	assert.Equal(t, uint64(2), stats.StaleServed)
+	assert.Equal(t, uint64(2), stats.Refreshes)
+	assert.True(t, stats.Staleness > 0)
+
+	// Once it's back, a refresh picks up the new value.
+	f.set([]byte("v2"), nil)
+	_, err = cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return cache.Stats().Staleness == 0 }, time.Second, time.Millisecond)
+
+	data, err = cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), data)
+}
+
+func TestGet_staleEvict(t *testing.T) {
+	cache, f := newFlakyCache(t, Config{MaxStaleness: time.Minute})
+	ctx := context.Background()
+
+	f.set([]byte("v1"), nil)
+	_, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+
+	f.set(nil, status.Error(codes.Unavailable, "unavailable"))
+	data, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), data)
+	assert.Eventually(t, func() bool { return cache.Stats().RefreshErrors == 1 }, time.Second, time.Millisecond)
+
+	// After Evict the old value is no longer served.
+	cache.Evict("example.com")
+	assert.Equal(t, 0, cache.Stats().StaleEntries)
+
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestGet_staleTooOld(t *testing.T) {
+	cache, f := newFlakyCache(t, Config{MaxStaleness: time.Millisecond})
+	ctx := context.Background()
+
+	f.set([]byte("v1"), nil)
+	_, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	f.set(nil, status.Error(codes.Unavailable, "unavailable"))
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 0, cache.Stats().StaleEntries)
+}
+
+func TestGet_staleNotTransient(t *testing.T) {
+	cache, f := newFlakyCache(t, Config{MaxStaleness: time.Minute})
+	ctx := context.Background()
+
+	f.set([]byte("v1"), nil)
+	_, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+
+	f.set(nil, status.Error(codes.PermissionDenied, "denied"))
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, uint64(0), cache.Stats().StaleServed)
+}
+
+func TestGet_staleDisabled(t *testing.T) {
+	cache, f := newFlakyCache(t, Config{})
+	ctx := context.Background()
+
+	f.set([]byte("v1"), nil)
+	_, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+
+	f.set(nil, status.Error(codes.Unavailable, "unavailable"))
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, Stats{}, cache.Stats())
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultHTTPTokenTTL is used when Config.HTTPTokenTTL is not set. Challenges
+// are normally answered within minutes of the token being stored.
+const defaultHTTPTokenTTL = time.Hour
+
+// isHTTPToken reports if a sanitized key is an http-01 challenge token.
+func isHTTPToken(key string) bool {
+	return strings.HasSuffix(key, sanitize(httpTokenSuffix))
+}
+
+// httpTokenTTL is how long http-01 challenge token secrets live.
+func (smc *SMCache) httpTokenTTL() time.Duration {
+	if smc.HTTPTokenTTL > 0 {
+		return smc.HTTPTokenTTL
+	}
+
+	return defaultHTTPTokenTTL
+}
+
+// tokenCache holds http-01 challenge tokens in memory, until they expire.
+// The zero value is ready to use.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[string]tokenEntry
+}
+
+type tokenEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+func (tc *tokenCache) get(key string) ([]byte, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	e, ok := tc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(tc.entries, key)
+		return nil, false
+	}
+
+	return e.data, true
+}
+
+func (tc *tokenCache) put(key string, data []byte, ttl time.Duration) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.entries == nil {
+		tc.entries = map[string]tokenEntry{}
+	}
+
+	// Expired tokens are dropped here too, so the map can't grow without bound.
+	now := time.Now()
+	for k, e := range tc.entries {
+		if now.After(e.expires) {
+			delete(tc.entries, k)
+		}
+	}
+
+	tc.entries[key] = tokenEntry{data: append([]byte(nil), data...), expires: now.Add(ttl)}
+}
+
+// len returns how many unexpired tokens are held.
+func (tc *tokenCache) len() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+
+	for _, e := range tc.entries {
+		if !now.After(e.expires) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (tc *tokenCache) remove(key string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	delete(tc.entries, key)
+}
+
+// SweepHTTPTokens deletes the secrets of http-01 challenge tokens under SecretPrefix
+// that were created more than HTTPTokenTTL ago. These are normally deleted by autocert,
+// or by Secret Manager once their TTL passes, but may be left behind by a process
+// that crashed before smcache set a TTL on them. Like GC, only secrets labelled as
+// created by smcache (see Entry.Managed) are deleted, so other secrets whose ID
+// happens to end in "_http-01" are left alone, even with an empty SecretPrefix.
+//
+// The names of the deleted secrets are returned. The sweep carries on past secrets
+// that could not be deleted, and returns an error describing them at the end.
+func (smc *SMCache) SweepHTTPTokens(ctx context.Context) ([]string, error) {
+	if err := smc.requireSecretManager("SweepHTTPTokens"); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return nil, err
+	}
+
+	client, err := smc.newClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer client.Close()
+
+	policy := smc.policyFor(sanitize(httpTokenSuffix))
+	prefix := policy.secretPrefix
+	suffix := sanitize(httpTokenSuffix)
+	cutoff := time.Now().Add(-smc.httpTokenTTL())
+
+	it := client.ListSecrets(&secretmanagerpb.ListSecretsRequest{
+		Parent: smc.secretsParent(policy),
+		Filter: "name:" + suffix,
+	})
+
+	var (
+		deleted  []string
+		failures []string
+	)
+
+	for {
+		s, err := it.Next()
+		if errors.Is(err, iterator.Done) || (err == nil && s == nil) {
+			break
+		}
+
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list secrets in [%v]. %w", smc.secretsParent(policy), err)
+		}
+
+		id := s.GetName()[strings.LastIndex(s.GetName(), "/")+1:]
+		if !strings.HasPrefix(id, prefix) || !strings.HasSuffix(id, suffix) ||
+			s.GetCreateTime().AsTime().After(cutoff) {
+			continue
+		}
+
+		if s.GetLabels()[managedLabel] != managedLabelValue {
+			smc.logf("SweepHTTPTokens skipping [%v], which smcache did not label as its own", s.GetName())
+			continue
+		}
+
+		err = client.DeleteSecret(&secretmanagerpb.DeleteSecretRequest{Name: s.GetName()})
+		if err != nil && status.Code(err) != codes.NotFound {
+			failures = append(failures, fmt.Sprintf("%v: %v", s.GetName(), err))
+			continue
+		}
+
+		smc.logf("Swept http-01 token secret %v", s.GetName())
+		deleted = append(deleted, s.GetName())
+	}
+
+	if len(failures) > 0 {
+		return deleted, fmt.Errorf("failed to delete %d token secrets: %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPut_httpToken_NewSecret(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("token auth")
+	secretPath := "projects/projId/secrets/abc123_http-01"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFakeNotFound{})
+	m.EXPECT().CreateSecret(&secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/projId",
+		SecretId: "abc123_http-01",
+		Secret: &secretmanagerpb.Secret{
+			Labels: map[string]string{managedLabel: managedLabelValue},
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{
+					Automatic: &secretmanagerpb.Replication_Automatic{},
+				},
+			},
+			Expiration: &secretmanagerpb.Secret_Ttl{Ttl: durationpb.New(10 * time.Minute)},
+		},
+	}).Return(nil, nil)
+	m.EXPECT().AddSecretVersion(gomock.Eq(&secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secretPath,
+		Payload: checksummed(secret),
+	})).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", HTTPTokenTTL: 10 * time.Minute, DebugLogging: debug}, m)
+	err := cache.Put(context.Background(), "abc123+http-01", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestPut_httpToken_noVersionCleanup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("token auth")
+	secretPath := "projects/projId/secrets/abc123_http-01"
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Eq(
+		&secretmanagerpb.ListSecretVersionsRequest{
+			Parent:   secretPath,
+			PageSize: listPageSize,
+		})).Return(
+		&sliFake{secrets: []*secretmanagerpb.SecretVersion{{
+			Name:  secretPath + "/versions/1",
+			State: secretmanagerpb.SecretVersion_ENABLED,
+		}}})
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	err := cache.Put(context.Background(), "abc123+http-01", secret)
+
+	assert.Nil(t, err)
+}
+
+func TestHTTPTokenMemoryCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := []byte("token auth")
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFakeNotFound{})
+	m.EXPECT().CreateSecret(gomock.Any()).Return(nil, nil)
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, nil)
+	m.EXPECT().DeleteSecret(gomock.Any()).Return(nil)
+	m.EXPECT().AccessSecretVersion(gomock.Any()).Return(nil, fmt.Errorf("should only be called after Delete"))
+	m.EXPECT().Close().Times(3)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", HTTPTokenMemoryCache: true, DebugLogging: debug}, m)
+
+	assert.Nil(t, cache.Put(context.Background(), "abc123+http-01", secret))
+
+	// Served from memory, without calling AccessSecretVersion.
+	result, err := cache.Get(context.Background(), "abc123+http-01")
+	assert.Nil(t, err)
+	assert.Equal(t, secret, result)
+
+	assert.Nil(t, cache.Delete(context.Background(), "abc123+http-01"))
+
+	_, err = cache.Get(context.Background(), "abc123+http-01")
+	assert.EqualError(t, err, "should only be called after Delete")
+}
+
+func TestTokenCache_expiry(t *testing.T) {
+	var tc tokenCache
+
+	tc.put("a", []byte("a"), -time.Second)
+	tc.put("b", []byte("b"), time.Hour)
+
+	_, ok := tc.get("a")
+	assert.False(t, ok)
+
+	data, ok := tc.get("b")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("b"), data)
+	assert.Len(t, tc.entries, 1)
+}
+
+func TestSweepHTTPTokens(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	old := timestamppb.New(time.Now().Add(-2 * time.Hour))
+	recent := timestamppb.Now()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Eq(&secretmanagerpb.ListSecretsRequest{
+		Parent: "projects/projId",
+		Filter: "name:_http-01",
+	})).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		{Name: "projects/projId/secrets/test-old_http-01", CreateTime: old, Labels: managedLabels()},
+		{Name: "projects/projId/secrets/test-recent_http-01", CreateTime: recent, Labels: managedLabels()},
+		{Name: "projects/projId/secrets/other-old_http-01", CreateTime: old, Labels: managedLabels()},
+		{Name: "projects/projId/secrets/test-failed_http-01", CreateTime: old, Labels: managedLabels()},
+		{Name: "projects/projId/secrets/test-example_com", CreateTime: old, Labels: managedLabels()},
+		{Name: "projects/projId/secrets/test-unlabelled_http-01", CreateTime: old},
+	}})
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/projId/secrets/test-old_http-01",
+	})).Return(nil)
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/projId/secrets/test-failed_http-01",
+	})).Return(fmt.Errorf("denied"))
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", SecretPrefix: "test-", DebugLogging: debug}, m)
+	deleted, err := cache.SweepHTTPTokens(context.Background())
+
+	assert.Equal(t, []string{"projects/projId/secrets/test-old_http-01"}, deleted)
+	assert.EqualError(t, err, "failed to delete 1 token secrets: projects/projId/secrets/test-failed_http-01: denied")
+}
+
+func TestSweepHTTPTokens_emptyPrefix(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	old := timestamppb.New(time.Now().Add(-2 * time.Hour))
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecrets(gomock.Any()).Return(&secretsFake{secrets: []*secretmanagerpb.Secret{
+		{Name: "projects/projId/secrets/foo_http-01", CreateTime: old},
+		{Name: "projects/projId/secrets/abc_http-01", CreateTime: old, Labels: managedLabels()},
+	}})
+	m.EXPECT().DeleteSecret(gomock.Eq(&secretmanagerpb.DeleteSecretRequest{
+		Name: "projects/projId/secrets/abc_http-01",
+	})).Return(nil)
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	deleted, err := cache.SweepHTTPTokens(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"projects/projId/secrets/abc_http-01"}, deleted)
+}
+
+// secretsFake is a SecretIterator over a fixed list of Secrets.
+type secretsFake struct {
+	secrets []*secretmanagerpb.Secret
+}
+
+func (sf *secretsFake) Next() (*secretmanagerpb.Secret, error) {
+	if len(sf.secrets) == 0 {
+		return nil, iterator.Done
+	}
+
+	s := sf.secrets[0]
+	sf.secrets = sf.secrets[1:]
+
+	return s, nil
+}
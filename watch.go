@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultWatchInterval is used when Config.WatchInterval is not set.
+const defaultWatchInterval = time.Minute
+
+// versionState is what Watch knows about the latest version of a secret.
+// The zero value means the secret does not exist.
+type versionState struct {
+	name  string
+	state VersionState
+	etag  string
+}
+
+// Watch polls the secret that stores key every WatchInterval, and calls fn with
+// the new data whenever its latest version changes, for example when another
+// replica Puts a renewed certificate. Changes are detected by the version's name,
+// state and etag, so a version disabled and enabled again between polls is seen. fn is called with nil data if the secret is
+// deleted, or its latest version can no longer be read.
+//
+// The first poll only records the current version, so fn is only called for
+// changes made after Watch starts. Keys are evicted (see Evict) before fn is called,
+// and fn can call Reloader.Reload to have autocert serve the new data.
+// Errors while polling are logged (if DebugLogging is enabled) and retried on the
+// next poll. Watch blocks until ctx is done, and then returns ctx.Err().
+func (smc *SMCache) Watch(ctx context.Context, key string, fn func(data []byte)) error {
+	if err := smc.resolveProjectID(ctx); err != nil {
+		return err
+	}
+
+	interval := smc.WatchInterval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	last, err := smc.latestVersion(ctx, sanitize(key))
+	if err != nil {
+		return fmt.Errorf("failed to watch [%v]. %w", key, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// The ticker may have fired as ctx was cancelled.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		next, data, err := smc.pollVersion(ctx, sanitize(key), last)
+		if err != nil {
+			smc.logf("Watch of [%v] failed, retrying in %v: %v", key, interval, err)
+			continue
+		}
+
+		if next == last {
+			continue
+		}
+
+		smc.logf("Watch of [%v] saw latest version change from [%v] to [%v]", key, last.name, next.name)
+		last = next
+
+		smc.Evict(key)
+		fn(data)
+	}
+}
+
+// pollVersion returns the state of the latest version of key and, if it changed
+// from last, the data stored in it.
+func (smc *SMCache) pollVersion(ctx context.Context, key string, last versionState) (versionState, []byte, error) {
+	next, err := smc.latestVersion(ctx, key)
+	if err != nil || next == last || next.name == "" || next.state != VersionEnabled {
+		return next, nil, err
+	}
+
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	conn, err := smc.backend().Open(ctx)
+	if err != nil {
+		return last, nil, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer conn.Close()
+
+	stored, version, err := conn.AccessLatest(smc.secretName(key))
+	if errors.Is(err, ErrNotFound) {
+		// The latest version was destroyed or disabled since.
+		return last, nil, nil
+	}
+
+	if err != nil {
+		return last, nil, err
+	}
+
+	data, err := decodePayload(stored)
+	if err != nil {
+		return last, nil, err
+	}
+
+	if version != next.name {
+		// A newer version was added since, which the next poll describes in full.
+		next = versionState{name: version, state: VersionEnabled}
+	}
+
+	return next, data, nil
+}
+
+// latestVersion gets the name and state of the latest version of key.
+func (smc *SMCache) latestVersion(ctx context.Context, key string) (versionState, error) {
+	ctx, cancel := smc.withTimeout(ctx)
+	defer cancel()
+
+	conn, err := smc.backend().Open(ctx)
+	if err != nil {
+		return versionState{}, fmt.Errorf("failed to setup client: %w", err)
+	}
+	defer conn.Close()
+
+	v, err := conn.LatestVersion(smc.secretName(key))
+	if errors.Is(err, ErrNotFound) {
+		return versionState{}, nil
+	}
+
+	if err != nil {
+		return versionState{}, err
+	}
+
+	return versionState{name: v.Name, state: v.State, etag: v.Etag}, nil
+}
+
+// Evict removes keys from smcache's in-memory caches, including the last good
+// values kept for MaxStaleness, so the next Get of each reads it from Secret Manager.
+// A Get already in flight for a key is not joined by later Gets.
+//
+// Evict does not reach autocert.Manager's own copy of the certificates it has
+// loaded. To serve a certificate renewed by another replica straight away, serve
+// through a Reloader and call Reload, for example from a Watch callback.
+func (smc *SMCache) Evict(keys ...string) {
+	for _, key := range keys {
+		key = sanitize(key)
+		smc.tokens.remove(key)
+		smc.misses.remove(key)
+		smc.stale.remove(key)
+		smc.gets.Forget(key)
+	}
+}
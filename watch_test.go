@@ -0,0 +1,157 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	latest := &secretmanagerpb.GetSecretVersionRequest{Name: "projects/projId/secrets/example_com/versions/latest"}
+	enabled := secretmanagerpb.SecretVersion_ENABLED
+	v1 := &secretmanagerpb.SecretVersion{Name: "projects/projId/secrets/example_com/versions/1", State: enabled}
+	v2 := &secretmanagerpb.SecretVersion{Name: "projects/projId/secrets/example_com/versions/2", State: enabled}
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	gomock.InOrder(
+		m.EXPECT().GetSecretVersion(gomock.Eq(latest)).Return(v1, nil),
+		m.EXPECT().GetSecretVersion(gomock.Eq(latest)).Return(nil, fmt.Errorf("unavailable")),
+		m.EXPECT().GetSecretVersion(gomock.Eq(latest)).Return(v1, nil),
+		m.EXPECT().GetSecretVersion(gomock.Eq(latest)).Return(v2, nil),
+		m.EXPECT().AccessSecretVersion(gomock.Eq(&secretmanagerpb.AccessSecretVersionRequest{
+			Name: "projects/projId/secrets/example_com/versions/latest",
+		})).
+			Return(&secretmanagerpb.AccessSecretVersionResponse{
+				Name:    v2.Name,
+				Payload: &secretmanagerpb.SecretPayload{Data: []byte("renewed")},
+			}, nil),
+		m.EXPECT().GetSecretVersion(gomock.Eq(latest)).Return(nil, status.Error(codes.NotFound, "deleted")),
+	)
+	m.EXPECT().Close().Times(6)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WatchInterval: time.Millisecond, DebugLogging: debug}, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got [][]byte
+
+	err := cache.Watch(ctx, "example.com", func(data []byte) {
+		got = append(got, data)
+		if data == nil {
+			cancel()
+		}
+	})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, [][]byte{[]byte("renewed"), nil}, got)
+}
+
+func TestWatch_etag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	enabled := secretmanagerpb.SecretVersion_ENABLED
+	name := "projects/projId/secrets/example_com/versions/1"
+
+	// The version was disabled and enabled again between polls, so only its etag changed.
+	m := apimocks.NewMockSecretClient(ctrl)
+	gomock.InOrder(
+		m.EXPECT().GetSecretVersion(gomock.Any()).Return(&secretmanagerpb.SecretVersion{Name: name, State: enabled, Etag: `"1"`}, nil),
+		m.EXPECT().GetSecretVersion(gomock.Any()).Return(&secretmanagerpb.SecretVersion{Name: name, State: enabled, Etag: `"1"`}, nil),
+		m.EXPECT().GetSecretVersion(gomock.Any()).Return(&secretmanagerpb.SecretVersion{Name: name, State: enabled, Etag: `"3"`}, nil),
+		m.EXPECT().AccessSecretVersion(gomock.Any()).Return(&secretmanagerpb.AccessSecretVersionResponse{
+			Name:    name,
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte("cert")},
+		}, nil),
+	)
+	m.EXPECT().Close().Times(4)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WatchInterval: time.Millisecond, DebugLogging: debug}, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got [][]byte
+
+	err := cache.Watch(ctx, "example.com", func(data []byte) {
+		got = append(got, data)
+		cancel()
+	})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, [][]byte{[]byte("cert")}, got)
+}
+
+func TestWatch_firstPollError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().GetSecretVersion(gomock.Any()).Return(nil, status.Error(codes.PermissionDenied, "denied"))
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", DebugLogging: debug}, m)
+	err := cache.Watch(context.Background(), "example.com", func([]byte) {})
+
+	assert.EqualError(t, err, "failed to watch [example.com]. rpc error: code = PermissionDenied desc = denied")
+}
+
+func TestWatch_memoryBackend(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId", Backend: NewMemoryBackend(), WatchInterval: time.Millisecond, DebugLogging: debug})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+
+	got := make(chan []byte, 1)
+	done := make(chan error)
+
+	go func() {
+		done <- cache.Watch(ctx, "example.com", func(data []byte) {
+			got <- data
+			cancel()
+		})
+	}()
+
+	// Watch only reports changes made after its first poll, so keep renewing until it sees one.
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-got:
+			assert.Equal(t, []byte("renewed"), data)
+			assert.Equal(t, context.Canceled, <-done)
+
+			return
+		case <-ticker.C:
+			assert.Nil(t, cache.Put(context.Background(), "example.com", []byte("renewed")))
+		}
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Failed writes are retried after minRetryDelay, doubling up to maxRetryDelay.
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+
+	// journalExt names the journal file of each pending write in Config.JournalDir.
+	journalExt = ".put"
+)
+
+// errQueueClosed is returned by Put and Flush once Close has stopped the worker.
+var errQueueClosed = errors.New("smcache: write-behind queue is closed")
+
+// writeQueue holds the Puts waiting to be written to Secret Manager, if
+// Config.WriteBehind is set.
+type writeQueue struct {
+	startOnce sync.Once
+	startErr  error
+
+	journal journal
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrite // by sanitized key
+	seq     uint64
+	lastErr error
+
+	// drained is closed once pending is empty. It is replaced when a write is queued.
+	drained chan struct{}
+
+	// wake asks the worker to write pending Puts now, instead of after its retry delay.
+	wake chan struct{}
+
+	// writing is held while a pending Put is written, so Delete can wait for it.
+	writing sync.Mutex
+
+	// closed is set by Close. stop asks the worker to return, and stopped is
+	// closed once it has. Both are nil if the worker was never started.
+	closed        bool
+	stop, stopped chan struct{}
+}
+
+type pendingWrite struct {
+	key  string // as passed to Put
+	data []byte
+	seq  uint64
+}
+
+// journal keeps pending writes across restarts.
+type journal interface {
+	save(key string, data []byte) error
+	remove(key string) error
+	load() (map[string][]byte, error)
+}
+
+// memJournal keeps pending writes in memory only.
+type memJournal struct{}
+
+func (memJournal) save(string, []byte) error        { return nil }
+func (memJournal) remove(string) error              { return nil }
+func (memJournal) load() (map[string][]byte, error) { return nil, nil }
+
+// diskJournal keeps each pending write in its own file in dir, named by a hash of
+// the sanitized key and holding the key as passed to Put, a newline, then the data.
+type diskJournal struct {
+	dir string
+}
+
+func (j diskJournal) path(key string) string {
+	sum := sha256.Sum256([]byte(sanitize(key)))
+	return filepath.Join(j.dir, hex.EncodeToString(sum[:])+journalExt)
+}
+
+func (j diskJournal) save(key string, data []byte) error {
+	if strings.Contains(key, "\n") {
+		return fmt.Errorf("key [%q] cannot be journaled", key)
+	}
+
+	f, err := os.CreateTemp(j.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	w.WriteString(key)
+	w.WriteByte('\n')
+	w.Write(data)
+
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), j.path(key))
+}
+
+func (j diskJournal) remove(key string) error {
+	if err := os.Remove(j.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (j diskJournal) load() (map[string][]byte, error) {
+	if err := os.MkdirAll(j.dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	// Left behind if the process stopped part way through save.
+	temps, _ := filepath.Glob(filepath.Join(j.dir, "*.tmp"))
+	for _, name := range temps {
+		os.Remove(name)
+	}
+
+	files, err := filepath.Glob(filepath.Join(j.dir, "*"+journalExt))
+	if err != nil {
+		return nil, err
+	}
+
+	writes := map[string][]byte{}
+
+	for _, name := range files {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		key, data, ok := bytes.Cut(b, []byte("\n"))
+		if !ok {
+			return nil, fmt.Errorf("journal file [%v] is corrupt", name)
+		}
+
+		writes[string(key)] = data
+	}
+
+	return writes, nil
+}
+
+// startQueue loads the journal and starts the worker, the first time it's called.
+func (smc *SMCache) startQueue() error {
+	q := &smc.queue
+
+	q.startOnce.Do(func() {
+		q.journal = memJournal{}
+		if smc.JournalDir != "" {
+			q.journal = diskJournal{dir: smc.JournalDir}
+		}
+
+		writes, err := q.journal.load()
+		if err != nil {
+			q.startErr = fmt.Errorf("failed to load write journal [%v]. %w", smc.JournalDir, err)
+			return
+		}
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.closed {
+			q.startErr = errQueueClosed
+			return
+		}
+
+		q.pending = map[string]*pendingWrite{}
+		q.drained = make(chan struct{})
+		q.wake = make(chan struct{}, 1)
+		q.stop = make(chan struct{})
+		q.stopped = make(chan struct{})
+
+		for key, data := range writes {
+			q.seq++
+			q.pending[sanitize(key)] = &pendingWrite{key: key, data: data, seq: q.seq}
+		}
+
+		if len(q.pending) == 0 {
+			close(q.drained)
+		} else {
+			smc.logf("write journal has %d pending writes", len(q.pending))
+		}
+
+		go smc.writeLoop()
+	})
+
+	return q.startErr
+}
+
+// enqueue journals a Put and returns, leaving the worker to write it to Secret Manager.
+func (smc *SMCache) enqueue(key string, data []byte) error {
+	sKey := sanitize(key)
+	if smc.policyFor(sKey).readOnly {
+		return fmt.Errorf("%w: cannot put [%v]", ErrReadOnly, sKey)
+	}
+
+	if err := smc.startQueue(); err != nil {
+		return err
+	}
+
+	q := &smc.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+
+	if err := q.journal.save(key, data); err != nil {
+		return fmt.Errorf("failed to journal [%v]. %w", sKey, err)
+	}
+
+	if len(q.pending) == 0 {
+		q.drained = make(chan struct{})
+	}
+
+	q.seq++
+	q.pending[sKey] = &pendingWrite{key: key, data: append([]byte(nil), data...), seq: q.seq}
+
+	smc.logf("PUT queued for: [%v]", sKey)
+	smc.wakeQueue()
+
+	return nil
+}
+
+// queued returns the data of a pending Put of the sanitized key.
+func (smc *SMCache) queued(key string) ([]byte, bool) {
+	if !smc.WriteBehind || smc.startQueue() != nil {
+		return nil, false
+	}
+
+	q := &smc.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w, ok := q.pending[key]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), w.data...), true
+}
+
+// dequeue drops any pending Put of the sanitized key, and returns once no write
+// of it is in progress. Call the returned func when done with the key.
+func (smc *SMCache) dequeue(key string) (func(), error) {
+	if !smc.WriteBehind {
+		return func() {}, nil
+	}
+
+	if err := smc.startQueue(); err != nil {
+		return nil, err
+	}
+
+	q := &smc.queue
+	q.writing.Lock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if w, ok := q.pending[key]; ok {
+		if err := q.journal.remove(w.key); err != nil {
+			q.writing.Unlock()
+			return nil, fmt.Errorf("failed to remove [%v] from the write journal. %w", key, err)
+		}
+
+		smc.done(key)
+	}
+
+	return q.writing.Unlock, nil
+}
+
+// done removes the sanitized key from pending. q.mu must be held.
+func (smc *SMCache) done(key string) {
+	q := &smc.queue
+	delete(q.pending, key)
+
+	if len(q.pending) == 0 {
+		q.lastErr = nil
+		close(q.drained)
+	}
+}
+
+func (smc *SMCache) wakeQueue() {
+	select {
+	case smc.queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush waits until every Put queued by Config.WriteBehind has been written to
+// Secret Manager, asking the worker to retry failed writes now. Call it before
+// the process exits. If ctx is done first, the error says how many writes are
+// still pending (they remain in Config.JournalDir, if it's set).
+func (smc *SMCache) Flush(ctx context.Context) error {
+	if !smc.WriteBehind {
+		return nil
+	}
+
+	if err := smc.startQueue(); err != nil {
+		return err
+	}
+
+	q := &smc.queue
+	q.mu.Lock()
+	drained, closed := q.drained, q.closed
+	q.mu.Unlock()
+
+	// Nothing will write what's still pending.
+	if closed {
+		select {
+		case <-drained:
+			return nil
+		default:
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			return fmt.Errorf("failed to flush %d pending writes. %w", len(q.pending), errQueueClosed)
+		}
+	}
+
+	smc.wakeQueue()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.lastErr != nil {
+			return fmt.Errorf("failed to flush %d pending writes [%v]. %w", len(q.pending), q.lastErr, ctx.Err())
+		}
+
+		return fmt.Errorf("failed to flush %d pending writes. %w", len(q.pending), ctx.Err())
+	}
+}
+
+// Close stops the worker that writes Puts queued by Config.WriteBehind, waiting
+// for a write in progress to finish. Puts still pending are not written: call
+// Flush first, or set Config.JournalDir so they are written after a restart.
+// After Close, Put returns an error if WriteBehind is set, as does Flush while
+// writes are pending.
+func (smc *SMCache) Close() error {
+	q := &smc.queue
+	q.mu.Lock()
+
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.closed = true
+	stop, stopped := q.stop, q.stopped
+	q.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+
+	return nil
+}
+
+// writeLoop writes pending Puts to Secret Manager, retrying with backoff until
+// they succeed or fail permanently, until Close is called.
+func (smc *SMCache) writeLoop() {
+	q := &smc.queue
+	defer close(q.stopped)
+
+	delay := minRetryDelay
+
+	for {
+		if smc.writePending() {
+			delay = minRetryDelay
+
+			select {
+			case <-q.wake:
+			case <-q.stop:
+				return
+			}
+
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-q.wake:
+		case <-timer.C:
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		case <-q.stop:
+			timer.Stop()
+			return
+		}
+
+		timer.Stop()
+	}
+}
+
+// writePending tries each pending Put once, and reports whether all succeeded.
+func (smc *SMCache) writePending() bool {
+	q := &smc.queue
+
+	q.mu.Lock()
+	keys := make([]string, 0, len(q.pending))
+
+	for key := range q.pending {
+		keys = append(keys, key)
+	}
+	q.mu.Unlock()
+
+	sort.Strings(keys)
+
+	ok := true
+
+	for _, key := range keys {
+		select {
+		case <-q.stop:
+			return false
+		default:
+		}
+
+		if err := smc.writeOne(key); err != nil {
+			smc.logf("problem writing queued PUT of [%v], will retry. %v", key, err)
+			smc.errs.add(OpPut, key, err)
+
+			q.mu.Lock()
+			q.lastErr = err
+			q.mu.Unlock()
+
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// writeOne writes the pending Put of the sanitized key, if there still is one.
+// A Put that failed permanently is dropped, and only recorded in RecentErrors.
+func (smc *SMCache) writeOne(key string) error {
+	q := &smc.queue
+
+	q.writing.Lock()
+	defer q.writing.Unlock()
+
+	q.mu.Lock()
+	w, ok := q.pending[key]
+	q.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if _, err := smc.put(context.Background(), w.key, w.data); err != nil {
+		if !isPermanent(err) {
+			return err
+		}
+
+		smc.logf("dropping queued PUT of [%v], which cannot succeed. %v", key, err)
+		smc.errs.add(OpPut, key, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// A newer Put of the key is written next time around.
+	if cur, ok := q.pending[key]; ok && cur.seq == w.seq {
+		if err := q.journal.remove(w.key); err != nil {
+			return fmt.Errorf("failed to remove [%v] from the write journal. %w", key, err)
+		}
+
+		smc.done(key)
+	}
+
+	return nil
+}
+
+// isPermanent reports whether a failed Put would fail the same way if retried.
+func isPermanent(err error) bool {
+	if errors.Is(err, ErrReadOnly) {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.PermissionDenied, codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	apimocks "github.com/jwendel/smcache/internal/api/mock"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPut_writeBehind(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	release := make(chan struct{})
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{})
+	m.EXPECT().AddSecretVersion(gomock.Any()).DoAndReturn(
+		func(req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+			<-release
+			assert.Equal(t, []byte("cert"), req.GetPayload().GetData())
+			return nil, nil
+		})
+	m.EXPECT().Close().Times(1)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WriteBehind: true, DebugLogging: debug}, m)
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+
+	// Queued data is read back without calling Secret Manager.
+	data, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("cert"), data)
+
+	close(release)
+	assert.Nil(t, cache.Flush(ctx))
+
+	_, ok := cache.queued("example_com")
+	assert.False(t, ok)
+}
+
+func TestPut_writeBehindRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}).Times(2)
+	gomock.InOrder(
+		m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, status.Error(codes.Unavailable, "unavailable")),
+		m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, nil),
+	)
+	m.EXPECT().Close().Times(2)
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WriteBehind: true, DebugLogging: debug}, m)
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+
+	// Flush retries straight away, rather than after the retry delay.
+	ctx, cancel := context.WithTimeout(ctx, minRetryDelay/2)
+	defer cancel()
+
+	assert.Nil(t, cache.Flush(ctx))
+}
+
+func TestFlush_timeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}).AnyTimes()
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, status.Error(codes.Unavailable, "unavailable")).AnyTimes()
+	m.EXPECT().Close().AnyTimes()
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WriteBehind: true, DebugLogging: debug}, m)
+
+	assert.Nil(t, cache.Put(context.Background(), "example.com", []byte("cert")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := cache.Flush(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "failed to flush 1 pending writes")
+}
+
+func TestPut_writeBehindJournal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir := t.TempDir()
+
+	// The first process can't reach Secret Manager before it stops.
+	down := apimocks.NewMockSecretClient(ctrl)
+	down.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}).AnyTimes()
+	down.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, status.Error(codes.Unavailable, "unavailable")).AnyTimes()
+	down.EXPECT().Close().AnyTimes()
+
+	config := Config{ProjectID: "projId", WriteBehind: true, JournalDir: dir, DebugLogging: debug}
+	first := newCacheWithMockGrpc(config, down)
+	assert.Nil(t, first.Put(context.Background(), "example.com+rsa", []byte("cert")))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, files, 1)
+
+	// The next one writes the journaled Put.
+	up := apimocks.NewMockSecretClient(ctrl)
+	up.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{})
+	up.EXPECT().AddSecretVersion(gomock.Any()).DoAndReturn(
+		func(req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+			assert.Equal(t, "projects/projId/secrets/example_com_rsa", req.GetParent())
+			assert.Equal(t, []byte("cert"), req.GetPayload().GetData())
+			return nil, nil
+		})
+	up.EXPECT().Close().Times(1)
+
+	second := newCacheWithMockGrpc(config, up)
+
+	data, err := second.Get(context.Background(), "example.com+rsa")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("cert"), data)
+
+	assert.Nil(t, second.Flush(context.Background()))
+
+	files, _ = filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, files)
+}
+
+func TestDelete_writeBehind(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}).AnyTimes()
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, status.Error(codes.Unavailable, "unavailable")).AnyTimes()
+	m.EXPECT().DeleteSecret(gomock.Any()).Return(nil)
+	m.EXPECT().Close().AnyTimes()
+
+	dir := t.TempDir()
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WriteBehind: true, JournalDir: dir, DebugLogging: debug}, m)
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+	assert.Nil(t, cache.Delete(ctx, "example.com"))
+
+	// Nothing is left to write.
+	assert.Nil(t, cache.Flush(ctx))
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPut_writeBehindPermanent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{})
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, status.Error(codes.PermissionDenied, "denied")).Times(1)
+	m.EXPECT().Close().Times(1)
+
+	dir := t.TempDir()
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WriteBehind: true, JournalDir: dir, DebugLogging: debug}, m)
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+
+	// The Put is dropped rather than retried.
+	ctx, cancel := context.WithTimeout(ctx, minRetryDelay/2)
+	defer cancel()
+
+	assert.Nil(t, cache.Flush(ctx))
+
+	errs := cache.RecentErrors()
+	assert.Len(t, errs, 1)
+	assert.Equal(t, OpPut, errs[0].Op)
+	assert.Contains(t, errs[0].Error, "denied")
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestClose_writeBehind(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := apimocks.NewMockSecretClient(ctrl)
+	m.EXPECT().ListSecretVersions(gomock.Any()).Return(&sliFake{}).AnyTimes()
+	m.EXPECT().AddSecretVersion(gomock.Any()).Return(nil, status.Error(codes.Unavailable, "unavailable")).AnyTimes()
+	m.EXPECT().Close().AnyTimes()
+
+	cache := newCacheWithMockGrpc(Config{ProjectID: "projId", WriteBehind: true, DebugLogging: debug}, m)
+	ctx := context.Background()
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")))
+	assert.Nil(t, cache.Close())
+
+	// The worker has returned.
+	select {
+	case <-cache.queue.stopped:
+	default:
+		t.Fatal("write-behind worker still running")
+	}
+
+	assert.ErrorIs(t, cache.Put(ctx, "other.example", []byte("cert")), errQueueClosed)
+
+	err := cache.Flush(ctx)
+	assert.ErrorIs(t, err, errQueueClosed)
+	assert.Contains(t, err.Error(), "failed to flush 1 pending writes")
+
+	assert.Nil(t, cache.Close())
+}
+
+func TestClose_notStarted(t *testing.T) {
+	cache := NewSMCache(Config{ProjectID: "projId", WriteBehind: true})
+
+	assert.Nil(t, cache.Close())
+	assert.ErrorIs(t, cache.Put(context.Background(), "example.com", []byte("cert")), errQueueClosed)
+}